@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/** Downtime alerts */
+
+// alert is the JSON body POSTed to -alertURL.
+type alert struct {
+	Service serviceName `json:"service"`
+	// State is "down" while the service is down and "recovered" once it's up.
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// Downtime is how long the service has been, or was, down.
+	Downtime duration  `json:"downtime"`
+	Time     time.Time `json:"timestamp"`
+}
+
+// alertState tracks a single application's downtime so it is only alerted on
+// once it has been down for -alertAfter, rather than on every blip.
+type alertState struct {
+	downSince time.Time
+	alerted   time.Time
+}
+
+// update is called after every check of app with its new status and sends any
+// alert or recovery notification that is due.
+func (s *alertState) update(name serviceName, status appStatus, now time.Time, config *daemonConfig) {
+	if config.alertURL == "" {
+		return
+	}
+
+	switch status {
+	case statusDown:
+		if s.downSince.IsZero() {
+			s.downSince = now
+		}
+		down := now.Sub(s.downSince)
+		if down < config.alertAfter {
+			return
+		}
+		if !s.alerted.IsZero() && (config.realertInterval <= 0 || now.Sub(s.alerted) < config.realertInterval) {
+			return
+		}
+		s.alerted = now
+		logWarn("%v has been down for %v, alerting.", name, down.Round(time.Second))
+		go sendAlert(config.alertURL, alert{Service: name, State: "down", Since: s.downSince, Downtime: duration(down), Time: now})
+	case statusUp:
+		if !s.alerted.IsZero() {
+			log.Printf("%v has recovered.", name)
+			go sendAlert(config.alertURL, alert{Service: name, State: "recovered", Since: s.downSince, Downtime: duration(now.Sub(s.downSince)), Time: now})
+		}
+		s.downSince, s.alerted = time.Time{}, time.Time{}
+	}
+}
+
+func sendAlert(alertURL string, a alert) {
+	if err := postJSON(alertURL, a); err != nil {
+		logError("Failed to send %v alert for %v: %v", a.State, a.Service, err)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/** Status API */
+
+// apiDrainTimeout bounds how long in-flight API requests get to finish when
+// the daemon shuts down.
+const apiDrainTimeout = 5 * time.Second
+
+type apiServer struct {
+	registry *registry
+	logStats *sourceStats
+	// logServers is how many log services (UDP, TCP and Unix socket) should
+	// be running.
+	logServers int
+	// stopping is closed when the API starts shutting down, ending any
+	// /events streams.
+	stopping chan struct{}
+}
+
+func startAPIServer(ctx context.Context, config *daemonConfig, r *registry, logStats *sourceStats) error {
+	port := config.apiPort
+	if port == 0 {
+		port = config.port
+	}
+
+	api := &apiServer{registry: r, logStats: logStats, stopping: make(chan struct{})}
+	if config.logServer {
+		api.logServers++
+	}
+	if config.tcpPort != 0 {
+		api.logServers++
+	}
+	if config.unixSocket != "" {
+		api.logServers++
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", api.handleStatus)
+	mux.HandleFunc("/status/down", api.handleStatusDown)
+	mux.HandleFunc("/applications", api.handleApplications)
+	mux.HandleFunc("/applications/drain", api.handleDrain)
+	mux.HandleFunc("/applications/undrain", api.handleDrain)
+	mux.HandleFunc("/logstats", api.handleLogStats)
+	mux.HandleFunc("/history", api.handleHistory)
+	mux.HandleFunc("/info", api.handleInfo)
+	mux.HandleFunc("/healthz", api.handleHealthz)
+	mux.HandleFunc("/events", api.handleEvents)
+	if config.metrics {
+		mux.HandleFunc("/metrics", api.handleMetrics)
+	}
+
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux}
+	server.RegisterOnShutdown(func() { close(api.stopping) })
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		drainCtx, cancel := context.WithTimeout(context.Background(), apiDrainTimeout)
+		defer cancel()
+		if err := server.Shutdown(drainCtx); err != nil {
+			logWarn("HTTP API didn't drain within %v, closing it.", apiDrainTimeout)
+			server.Close()
+		}
+	}()
+
+	log.Printf("Starting HTTP API on port %d.", port)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	// ListenAndServe returns as soon as Shutdown starts; wait for in-flight
+	// requests to finish.
+	<-drained
+	log.Println("HTTP API stopped.")
+	return nil
+}
+
+// handleStatus lists the registered applications, optionally only those
+// carrying every label=value given as a label query parameter, e.g.
+// /status?label=team=payments.
+func (api *apiServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	applications, ok := api.selectApplications(w, req)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, applications)
+}
+
+// downApplication is an application listed by /status/down, along with how
+// long it has been down or degraded.
+type downApplication struct {
+	application
+	For duration `json:"for"`
+}
+
+// handleStatusDown lists only the applications that are down or degraded,
+// filtered by label like /status.
+func (api *apiServer) handleStatusDown(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	applications, ok := api.selectApplications(w, req)
+	if !ok {
+		return
+	}
+	down := []downApplication{}
+	now := time.Now()
+	for _, app := range applications {
+		if app.Status != statusDown && app.Status != statusDegraded {
+			continue
+		}
+		down = append(down, downApplication{application: app, For: duration(now.Sub(app.LastTransition))})
+	}
+	writeJSON(w, http.StatusOK, down)
+}
+
+// selectApplications returns the registered applications carrying every label
+// in the request's label parameters, replying with an error and returning
+// false if a label is malformed.
+func (api *apiServer) selectApplications(w http.ResponseWriter, req *http.Request) ([]application, bool) {
+	selector := make(map[string]string)
+	for _, label := range req.URL.Query()["label"] {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			http.Error(w, "label must be key=value, got "+label, http.StatusBadRequest)
+			return nil, false
+		}
+		selector[key] = value
+	}
+
+	applications := []application{}
+	now := time.Now()
+	for _, app := range api.registry.snapshot() {
+		if !app.hasLabels(selector) {
+			continue
+		}
+		// Report the time spent in the current state so far as well.
+		applications = append(applications, app.withCurrentTotals(now).redacted())
+	}
+	return applications, true
+}
+
+// redactedValue stands in for secrets in API responses.
+const redactedValue = "REDACTED"
+
+// redacted returns a copy of a that is safe to serve, with the values of its
+// health-check headers and environment variables replaced since they often
+// hold credentials.
+func (a application) redacted() application {
+	a.HeartbeatHeaders = redactValues(a.HeartbeatHeaders)
+	a.Env = redactValues(a.Env)
+	return a
+}
+
+// redactValues returns a copy of m with every value replaced by redactedValue,
+// so which keys are set still shows.
+func redactValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(m))
+	for key := range m {
+		redacted[key] = redactedValue
+	}
+	return redacted
+}
+
+// daemonInfo is the body of /info.
+type daemonInfo struct {
+	Version      string    `json:"version"`
+	Commit       string    `json:"commit"`
+	Started      time.Time `json:"started"`
+	Uptime       duration  `json:"uptime"`
+	Applications int       `json:"applications"`
+}
+
+// handleInfo reports the build that is running, how long it has been up and
+// how many applications it has registered.
+func (api *apiServer) handleInfo(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, daemonInfo{
+		Version:      version,
+		Commit:       commit,
+		Started:      daemonStarted,
+		Uptime:       duration(time.Since(daemonStarted).Truncate(time.Second)),
+		Applications: len(api.registry.snapshot()),
+	})
+}
+
+// handleLogStats reports how many log messages and bytes each source has sent.
+func (api *apiServer) handleLogStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.logStats.snapshot())
+}
+
+func (api *apiServer) handleApplications(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		api.registerApplication(w, req)
+	case http.MethodDelete:
+		api.deregisterApplication(w, req)
+	default:
+		methodNotAllowed(w, http.MethodPost+", "+http.MethodDelete)
+	}
+}
+
+// registerApplication adds the application in the request body to the registry
+// and starts health-checking it.
+func (api *apiServer) registerApplication(w http.ResponseWriter, req *http.Request) {
+	var app application
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&app); err != nil {
+		http.Error(w, "invalid application: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Runtime state such as status or pid is the daemon's to find out.
+	app = app.definition()
+	app.Status = statusUnknown
+	if app.Group != "" {
+		http.Error(w, "groups are only supported in the app file", http.StatusBadRequest)
+		return
+	}
+	if err := app.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := api.registry.add(app); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	// Monitor the registered copy, which carries the application's logger.
+	app, _ = api.registry.get(app.ServiceName)
+	go api.registry.monitor(api.registry.monitorContext(app.ServiceName), app)
+
+	log.Printf("Registered %v.", app.ServiceName)
+	writeJSON(w, http.StatusCreated, app.redacted())
+}
+
+// handleDrain drains (or, under /applications/undrain, undrains) the
+// application named by the name query parameter.
+func (api *apiServer) handleDrain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	name := serviceName(req.URL.Query().Get("name"))
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	draining := req.URL.Path == "/applications/drain"
+	if !api.registry.setDraining(name, draining) {
+		http.Error(w, "Service "+string(name)+" not found", http.StatusNotFound)
+		return
+	}
+	if draining {
+		log.Printf("Draining %v.", name)
+	} else {
+		log.Printf("Undrained %v.", name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deregisterApplication removes the application matching the name or url query
+// parameter and stops health-checking it. A url shared by several applications
+// is rejected, as it's unclear which to remove.
+func (api *apiServer) deregisterApplication(w http.ResponseWriter, req *http.Request) {
+	name := serviceName(req.URL.Query().Get("name"))
+	url := req.URL.Query().Get("url")
+	if name == "" && url == "" {
+		http.Error(w, "name or url is required", http.StatusBadRequest)
+		return
+	}
+
+	if name == "" {
+		names := api.registry.findByURL(url)
+		switch len(names) {
+		case 0:
+			http.Error(w, "Service at url "+url+" not found", http.StatusNotFound)
+			return
+		case 1:
+			name = names[0]
+		default:
+			matches := make([]string, len(names))
+			for i, match := range names {
+				matches[i] = string(match)
+			}
+			http.Error(w, "url "+url+" matches "+strings.Join(matches, ", ")+", deregister by name instead", http.StatusConflict)
+			return
+		}
+	}
+	if err := api.registry.removeByName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logError("Failed to write response: %v", err)
+	}
+}
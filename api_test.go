@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestStatusRedactsSecrets checks that /status and /status/down don't serve
+// the values of an application's health-check headers or environment.
+func TestStatusRedactsSecrets(t *testing.T) {
+	r := newTestRegistry(t, nil, application{
+		ServiceName:      "api",
+		HeartbeatURL:     "http://127.0.0.1:1/health",
+		HeartbeatHeaders: map[string]string{"Authorization": "Bearer SECRET"},
+		Env:              map[string]string{"DB_PASSWORD": "hunter2"},
+	})
+	r.applications[0].Status = statusDown
+	api := &apiServer{registry: r}
+
+	for path, handler := range map[string]http.HandlerFunc{
+		"/status":      api.handleStatus,
+		"/status/down": api.handleStatusDown,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		body := w.Body.String()
+		if strings.Contains(body, "SECRET") || strings.Contains(body, "hunter2") {
+			t.Errorf("%v leaks a secret: %s", path, body)
+		}
+		if !strings.Contains(body, `"Authorization":"REDACTED"`) {
+			t.Errorf("%v doesn't list the redacted header: %s", path, body)
+		}
+		if !strings.Contains(body, `"DB_PASSWORD":"REDACTED"`) {
+			t.Errorf("%v doesn't list the redacted variable: %s", path, body)
+		}
+	}
+	if got := r.applications[0].HeartbeatHeaders["Authorization"]; got != "Bearer SECRET" {
+		t.Errorf("registered header changed to %q", got)
+	}
+	if got := r.applications[0].Env["DB_PASSWORD"]; got != "hunter2" {
+		t.Errorf("registered variable changed to %q", got)
+	}
+}
+
+// TestRegisterIgnoresRuntimeState checks that POST /applications doesn't let a
+// client set an application's status, pid or other runtime state.
+func TestRegisterIgnoresRuntimeState(t *testing.T) {
+	r := newTestRegistry(t, nil)
+	api := &apiServer{registry: r}
+
+	body := `{"name": "api", "healthcheckURL": "http://127.0.0.1:1/health", "status": "up", "pid": 4242, "restarts": 9, "draining": true}`
+	w := httptest.NewRecorder()
+	api.registerApplication(w, httptest.NewRequest(http.MethodPost, "/applications", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /applications responded %d: %s", w.Code, w.Body)
+	}
+	r.stopMonitors()
+
+	app, ok := r.get("api")
+	if !ok {
+		t.Fatal("api wasn't registered")
+	}
+	if app.Status != statusUnknown || app.PID != 0 || app.Restarts != 0 || app.Draining {
+		t.Errorf("registered with status %q, pid %d, %d restarts, draining %v, want %q and none", app.Status, app.PID, app.Restarts, app.Draining, statusUnknown)
+	}
+}
+
+// TestStatusOmitsUnstarted checks that /status leaves out when an application
+// was started if the daemon never started it.
+func TestStatusOmitsUnstarted(t *testing.T) {
+	r := newTestRegistry(t, nil, application{ServiceName: "api", HeartbeatURL: "http://127.0.0.1:1/health"})
+	api := &apiServer{registry: r}
+
+	w := httptest.NewRecorder()
+	api.handleStatus(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if body := w.Body.String(); strings.Contains(body, `"started"`) {
+		t.Errorf("/status lists a start time for an application that wasn't started: %s", body)
+	}
+}
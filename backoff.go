@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+/** Retry backoff */
+
+// backoffStrategy decides how long to wait before retry attempt (counting from
+// 0).
+type backoffStrategy interface {
+	nextDelay(attempt int) time.Duration
+}
+
+// backoffStrategies are the strategies -healthBackoffStrategy can pick, each
+// built from the base delay and the most it may grow to.
+var backoffStrategies = map[string]func(base, max time.Duration) backoffStrategy{
+	"constant": func(base, max time.Duration) backoffStrategy {
+		return constantDelay{delay: base}
+	},
+	"linear": func(base, max time.Duration) backoffStrategy {
+		return linearDelay{base: base, max: max}
+	},
+	"exponential": func(base, max time.Duration) backoffStrategy {
+		return exponentialDelay{base: base, max: max}
+	},
+}
+
+// backoffStrategyNames lists the strategies -healthBackoffStrategy accepts.
+func backoffStrategyNames() []string {
+	names := make([]string, 0, len(backoffStrategies))
+	for name := range backoffStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// constantDelay waits the same time before every retry.
+type constantDelay struct {
+	delay time.Duration
+}
+
+func (b constantDelay) nextDelay(attempt int) time.Duration {
+	return b.delay
+}
+
+// linearDelay waits base longer before each retry, up to max.
+type linearDelay struct {
+	base, max time.Duration
+}
+
+func (b linearDelay) nextDelay(attempt int) time.Duration {
+	delay := b.base * time.Duration(attempt+1)
+	if delay > b.max || delay < 0 {
+		delay = b.max
+	}
+	return delay
+}
+
+// exponentialDelay doubles the wait before each retry, up to max.
+type exponentialDelay struct {
+	base, max time.Duration
+}
+
+func (b exponentialDelay) nextDelay(attempt int) time.Duration {
+	return exponentialBackoff(b.base, attempt, b.max)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/** Batched log forwarding */
+
+// logBatcher collects forwarded logs and queues them for every forward URL as
+// a JSON array once maxSize have built up or interval has passed, whichever
+// comes first.
+type logBatcher struct {
+	queues   []*forwardQueue
+	maxSize  int
+	interval time.Duration
+
+	mutex   sync.Mutex
+	pending []forwardedLog
+	// full is signalled when pending reaches maxSize.
+	full chan struct{}
+}
+
+func newLogBatcher(queues []*forwardQueue, maxSize int, interval time.Duration) *logBatcher {
+	return &logBatcher{
+		queues:   queues,
+		maxSize:  maxSize,
+		interval: interval,
+		full:     make(chan struct{}, 1),
+	}
+}
+
+// add queues entry for the next batch.
+func (b *logBatcher) add(entry forwardedLog) {
+	b.mutex.Lock()
+	b.pending = append(b.pending, entry)
+	full := len(b.pending) >= b.maxSize
+	b.mutex.Unlock()
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run flushes batches until ctx is done, then flushes whatever is left.
+func (b *logBatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.flush()
+			return
+		case <-ticker.C:
+			b.flush()
+		case <-b.full:
+			b.flush()
+		}
+	}
+}
+
+// flush queues everything pending in batches of at most maxSize.
+func (b *logBatcher) flush() {
+	b.mutex.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mutex.Unlock()
+
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > b.maxSize {
+			n = b.maxSize
+		}
+		for _, queue := range b.queues {
+			queue.push(pending[:n], n)
+		}
+		pending = pending[n:]
+	}
+}
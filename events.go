@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/** State-change events */
+
+// eventBufferSize is how many state changes can wait to be forwarded before
+// new ones are dropped.
+const eventBufferSize = 64
+
+// sseKeepAlive is how often an idle /events stream gets a comment, so clients
+// and proxies don't time it out and gone clients are noticed.
+const sseKeepAlive = 30 * time.Second
+
+// stateEvent records an application moving from one status to another.
+type stateEvent struct {
+	Service serviceName `json:"service"`
+	Old     appStatus   `json:"old"`
+	New     appStatus   `json:"new"`
+	Time    time.Time   `json:"timestamp"`
+}
+
+// eventDestination is where state changes are POSTed: -eventURL, or the first
+// log -forward URL when that isn't set.
+func (config *daemonConfig) eventDestination() string {
+	if config.eventURL != "" || len(config.forward) == 0 {
+		return config.eventURL
+	}
+	return config.forward[0]
+}
+
+// publish queues event for forwarding without ever blocking a health check;
+// if the queue is full the event is dropped.
+func (r *registry) publish(event stateEvent) {
+	r.subscribers.broadcast(event)
+	if r.events == nil {
+		return
+	}
+	select {
+	case r.events <- event:
+	default:
+		logWarn("Dropped %v state change event, the event queue is full.", event.Service)
+	}
+}
+
+// forwardEvents POSTs each event to eventURL as JSON until ctx is done.
+func forwardEvents(ctx context.Context, events <-chan stateEvent, eventURL string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if err := postJSON(eventURL, event); err != nil {
+				logError("Failed to forward %v state change: %v", event.Service, err)
+			}
+		}
+	}
+}
+
+// eventSubscribers fans state changes out to the clients streaming /events.
+type eventSubscribers struct {
+	mutex       sync.Mutex
+	subscribers map[chan stateEvent]struct{}
+	// max is the most clients that may stream at once.
+	max int
+}
+
+func newEventSubscribers(max int) *eventSubscribers {
+	return &eventSubscribers{subscribers: make(map[chan stateEvent]struct{}), max: max}
+}
+
+// subscribe returns a channel receiving every state change from now on, or
+// false if there are already max subscribers.
+func (s *eventSubscribers) subscribe() (chan stateEvent, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.subscribers) >= s.max {
+		return nil, false
+	}
+	events := make(chan stateEvent, eventBufferSize)
+	s.subscribers[events] = struct{}{}
+	return events, true
+}
+
+func (s *eventSubscribers) unsubscribe(events chan stateEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscribers, events)
+}
+
+// broadcast sends event to every subscriber without blocking; a subscriber
+// too slow to keep up misses it.
+func (s *eventSubscribers) broadcast(event stateEvent) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// handleEvents streams state changes to the client as Server-Sent Events until
+// it disconnects or the API shuts down.
+func (api *apiServer) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, ok := api.registry.subscribers.subscribe()
+	if !ok {
+		http.Error(w, "too many event subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer api.registry.subscribers.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-api.stopping:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
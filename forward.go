@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/** Log forwarding queue */
+
+const (
+	forwardRetryBackoff    = 500 * time.Millisecond
+	maxForwardRetryBackoff = 10 * time.Second
+)
+
+// queuedLogs is a single POST waiting to be sent: one log, or a batch of them.
+type queuedLogs struct {
+	body  interface{}
+	count int
+}
+
+// forwardQueue sends logs to the forward URL one POST at a time, retrying
+// failures with exponential backoff so a briefly unavailable collector doesn't
+// lose them. It holds at most maxSize POSTs; when full the oldest is dropped.
+type forwardQueue struct {
+	forwardURL string
+	maxSize    int
+	retries    int
+	// gzip compresses each POST, for -forwardGzip.
+	gzip bool
+
+	mutex  sync.Mutex
+	items  []queuedLogs
+	closed bool
+	// ready is signalled whenever an item is pushed or the queue is closed.
+	ready chan struct{}
+}
+
+func newForwardQueue(forwardURL string, maxSize, retries int, gzip bool) *forwardQueue {
+	return &forwardQueue{
+		forwardURL: forwardURL,
+		maxSize:    maxSize,
+		retries:    retries,
+		gzip:       gzip,
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// push queues body, which holds count logs, dropping the oldest POST if the
+// queue is full.
+func (q *forwardQueue) push(body interface{}, count int) {
+	q.mutex.Lock()
+	if q.maxSize > 0 && len(q.items) >= q.maxSize {
+		dropped := q.items[0]
+		q.items = q.items[1:]
+		counters.logsDropped.Add(uint64(dropped.count))
+		logWarn("Forward queue is full, dropped %d logs.", dropped.count)
+	}
+	q.items = append(q.items, queuedLogs{body: body, count: count})
+	q.mutex.Unlock()
+	q.signal()
+}
+
+// close lets run return once everything queued has been sent.
+func (q *forwardQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.signal()
+}
+
+func (q *forwardQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the oldest queued POST, reporting whether there was one and
+// whether the queue has been closed.
+func (q *forwardQueue) pop() (item queuedLogs, ok, closed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.items) == 0 {
+		return queuedLogs{}, false, q.closed
+	}
+	item = q.items[0]
+	q.items = q.items[1:]
+	return item, true, q.closed
+}
+
+// run sends queued POSTs until the queue is closed and empty. Once ctx is done
+// failures are no longer retried, so shutdown isn't held up by a dead
+// collector.
+func (q *forwardQueue) run(ctx context.Context) {
+	for {
+		item, ok, closed := q.pop()
+		if !ok {
+			if closed {
+				return
+			}
+			<-q.ready
+			continue
+		}
+		q.send(ctx, item)
+	}
+}
+
+// send POSTs item, retrying with backoff up to q.retries times.
+func (q *forwardQueue) send(ctx context.Context, item queuedLogs) {
+	for attempt := 0; ; attempt++ {
+		var err error
+		if q.gzip {
+			err = postGzipJSON(q.forwardURL, item.body)
+		} else {
+			err = postJSON(q.forwardURL, item.body)
+		}
+		if err == nil {
+			counters.logsForwarded.Add(uint64(item.count))
+			return
+		}
+		if attempt >= q.retries || ctx.Err() != nil {
+			logError("Failed to forward %d logs, dropping them: %v", item.count, err)
+			counters.logsDropped.Add(uint64(item.count))
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(exponentialBackoff(forwardRetryBackoff, attempt, maxForwardRetryBackoff)):
+		}
+	}
+}
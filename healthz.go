@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/** Daemon liveness */
+
+// staleTicks is how many check intervals may pass without a health check
+// completing before the checks are considered hung.
+const staleTicks = 3
+
+// liveness records whether the daemon's own loops are running, for /healthz.
+var liveness struct {
+	// checked is when a health check last completed, in Unix nanoseconds,
+	// or when health checks are due to begin if none has completed yet.
+	checked atomic.Int64
+	// logServers counts the UDP, TCP and Unix socket log services currently
+	// listening.
+	logServers atomic.Int32
+}
+
+// checksBegin records that health checks begin after delay, so /healthz gives
+// the first ones time to complete.
+func checksBegin(delay time.Duration) {
+	liveness.checked.Store(time.Now().Add(delay).UnixNano())
+}
+
+// checkCompleted records that a health check finished, whatever its result.
+func checkCompleted() {
+	liveness.checked.Store(time.Now().UnixNano())
+}
+
+// checkBudget is the longest a single check of app may take: every attempt
+// timing out, with the backoff between them.
+func checkBudget(app application, config *daemonConfig) time.Duration {
+	attempts := config.healthRetries
+	if attempts < 1 {
+		attempts = 1
+	}
+	budget := time.Duration(attempts) * app.checkTimeout(config.healthTimeout)
+	backoff := backoffStrategies[config.healthBackoffStrategy](config.healthBackoff, maxHealthBackoff)
+	for attempt := 0; attempt < attempts-1; attempt++ {
+		budget += backoff.nextDelay(attempt)
+	}
+	return budget
+}
+
+// daemonHealth is the body of /healthz.
+type daemonHealth struct {
+	Status     string    `json:"status"`
+	LastCheck  time.Time `json:"lastCheck"`
+	LogServers int       `json:"logServers"`
+	Problems   []string  `json:"problems,omitempty"`
+}
+
+// handleHealthz reports 200 while health checks keep completing and every log
+// service that was asked for is listening, and 503 otherwise. Checks are hung
+// once none has completed for staleTicks of the longest interval and check
+// among the applications being checked.
+func (api *apiServer) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	health := daemonHealth{Status: "ok", LogServers: int(liveness.logServers.Load())}
+	config := api.registry.config.Load()
+	var allowed time.Duration
+	for _, app := range api.registry.snapshot() {
+		// Draining applications aren't checked.
+		if app.Draining {
+			continue
+		}
+		stale := staleTicks*app.checkInterval(config.interval) + checkBudget(app, app.checkConfig(config))
+		if stale > allowed {
+			allowed = stale
+		}
+	}
+	if checked := liveness.checked.Load(); checked == 0 {
+		if allowed > 0 {
+			health.Problems = append(health.Problems, "health checks haven't started")
+		}
+	} else {
+		last := time.Unix(0, checked)
+		if !last.After(time.Now()) {
+			health.LastCheck = last
+		}
+		if allowed > 0 && time.Since(last) > allowed {
+			health.Problems = append(health.Problems, "no health check has completed since "+last.Format(time.RFC3339))
+		}
+	}
+	if health.LogServers < api.logServers {
+		health.Problems = append(health.Problems, "log service isn't running")
+	}
+
+	code := http.StatusOK
+	if len(health.Problems) > 0 {
+		health.Status = "unhealthy"
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, health)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHealthzStaleChecks checks that /healthz turns unhealthy once no health
+// check has completed for longer than the applications' checks may take.
+func TestHealthzStaleChecks(t *testing.T) {
+	r := newTestRegistry(t, []string{"-Interval=1s", "-healthTimeout=1s", "-healthRetries=1"},
+		application{ServiceName: "api", HeartbeatURL: "http://127.0.0.1:1/health"})
+	api := &apiServer{registry: r}
+
+	// Allowed: 3 intervals plus one 1s attempt.
+	for _, test := range []struct {
+		lastCheck time.Duration
+		want      int
+	}{
+		{lastCheck: time.Second, want: http.StatusOK},
+		{lastCheck: 3 * time.Second, want: http.StatusOK},
+		{lastCheck: 5 * time.Second, want: http.StatusServiceUnavailable},
+	} {
+		liveness.checked.Store(time.Now().Add(-test.lastCheck).UnixNano())
+		w := httptest.NewRecorder()
+		api.handleHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if w.Code != test.want {
+			t.Errorf("last check %v ago: /healthz responded %d, want %d: %s", test.lastCheck, w.Code, test.want, w.Body)
+		}
+	}
+
+	// Draining applications aren't checked, so nothing is expected of them.
+	r.setDraining("api", true)
+	w := httptest.NewRecorder()
+	api.handleHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("only draining applications: /healthz responded %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	liveness.checked.Store(0)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+/** Self heartbeat */
+
+// selfHeartbeat is the JSON body POSTed to -selfHeartbeatURL.
+type selfHeartbeat struct {
+	Status   string    `json:"status"`
+	Hostname string    `json:"hostname,omitempty"`
+	PID      int       `json:"pid"`
+	Time     time.Time `json:"timestamp"`
+}
+
+// sendSelfHeartbeats POSTs a "daemon alive" ping to heartbeatURL every
+// interval until ctx is done, so an external watchdog notices if the daemon
+// itself stops.
+func sendSelfHeartbeats(ctx context.Context, heartbeatURL string, interval time.Duration) {
+	hostname, _ := os.Hostname()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ping := selfHeartbeat{Status: "alive", Hostname: hostname, PID: os.Getpid(), Time: time.Now()}
+		if err := postJSON(heartbeatURL, ping); err != nil {
+			logError("Failed to send self heartbeat: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+/** Health-check history */
+
+// checkResult is the outcome of a single health-check probe.
+type checkResult struct {
+	Time       time.Time `json:"time"`
+	OK         bool      `json:"ok"`
+	Latency    duration  `json:"latency"`
+	StatusCode int       `json:"statusCode,omitempty"`
+}
+
+// checkHistory is a fixed-size ring buffer of recent check results; once full,
+// each new result overwrites the oldest.
+type checkHistory struct {
+	results []checkResult
+	next    int
+	full    bool
+}
+
+func newCheckHistory(size int) *checkHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &checkHistory{results: make([]checkResult, size)}
+}
+
+func (h *checkHistory) add(result checkResult) {
+	h.results[h.next] = result
+	h.next = (h.next + 1) % len(h.results)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the results from oldest to newest.
+func (h *checkHistory) list() []checkResult {
+	if !h.full {
+		return append([]checkResult(nil), h.results[:h.next]...)
+	}
+	return append(append([]checkResult(nil), h.results[h.next:]...), h.results[:h.next]...)
+}
+
+// recordResult adds result to name's history.
+func (r *registry) recordResult(name serviceName, result checkResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	history, ok := r.history[name]
+	if !ok {
+		history = newCheckHistory(r.historySize)
+		r.history[name] = history
+	}
+	history.add(result)
+}
+
+// results returns name's recent check results, oldest first, and whether it is
+// registered.
+func (r *registry) results(name serviceName) ([]checkResult, bool) {
+	if _, ok := r.get(name); !ok {
+		return nil, false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	history, ok := r.history[name]
+	if !ok {
+		return []checkResult{}, true
+	}
+	return history.list(), true
+}
+
+// handleHistory serves the recent check results of the application named by
+// the name query parameter.
+func (api *apiServer) handleHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	name := serviceName(req.URL.Query().Get("name"))
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	results, ok := api.registry.results(name)
+	if !ok {
+		http.Error(w, "Service "+string(name)+" not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/** Local log file */
+
+// rotatingFile appends lines to a file, renaming it to path.1 (and older ones
+// to path.2, path.3 ...) once it grows past maxSize. It is safe for concurrent
+// use.
+type rotatingFile struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens path for appending. The caller must hold f.mutex, unless f isn't
+// shared yet.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// writeJSON appends v as a single JSON line.
+func (f *rotatingFile) writeJSON(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts a new file.
+// The caller must hold f.mutex.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.backups > 0 {
+		for i := f.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/** Daemon log format */
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Levels of -logFormat=json log lines. Lines logged with the log package's own
+// functions are info.
+const (
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+// logLine is a single daemon log message in -logFormat=json.
+type logLine struct {
+	Time    time.Time   `json:"ts"`
+	Level   string      `json:"level"`
+	Service serviceName `json:"service,omitempty"`
+	Msg     string      `json:"msg"`
+}
+
+// jsonLogWriter turns each line written by a log.Logger without flags into a
+// JSON object. A "[name] " prefix, as written by the per-application loggers,
+// becomes the service field.
+type jsonLogWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.writeLine(levelInfo, string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeLine writes a single log line at level.
+func (w *jsonLogWriter) writeLine(level, msg string) error {
+	line := logLine{Time: time.Now(), Level: level, Msg: strings.TrimSuffix(msg, "\n")}
+	if strings.HasPrefix(line.Msg, "[") {
+		if end := strings.Index(line.Msg, "] "); end > 0 {
+			line.Service = serviceName(line.Msg[1:end])
+			line.Msg = line.Msg[end+2:]
+		}
+	}
+
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(line); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := w.out.Write(b.Bytes())
+	return err
+}
+
+// logAt logs a message through logger at level. The level only shows in
+// -logFormat=json, text logs read the same whatever it is.
+func logAt(logger *log.Logger, level, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if w, ok := logger.Writer().(*jsonLogWriter); ok {
+		w.writeLine(level, logger.Prefix()+msg)
+		return
+	}
+	logger.Output(2, msg)
+}
+
+// logWarn logs a message through the daemon's log at warn level.
+func logWarn(format string, args ...interface{}) {
+	logAt(log.Default(), levelWarn, format, args...)
+}
+
+// logError logs a message through the daemon's log at error level.
+func logError(format string, args ...interface{}) {
+	logAt(log.Default(), levelError, format, args...)
+}
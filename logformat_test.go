@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"testing"
+)
+
+// TestJSONLogLevels checks that -logFormat=json lines carry the level they were
+// logged at, whatever the message says.
+func TestJSONLogLevels(t *testing.T) {
+	var out bytes.Buffer
+	daemon := log.New(&jsonLogWriter{out: &out}, "", 0)
+	app := log.New(daemon.Writer(), "[api] ", log.Lmsgprefix)
+
+	daemon.Println("Failed a check during its start-up grace, not counting it.")
+	logAt(app, levelWarn, "Down.")
+	logAt(app, levelError, "Still down after %d restarts, giving up.", 3)
+
+	want := []logLine{
+		{Level: levelInfo, Msg: "Failed a check during its start-up grace, not counting it."},
+		{Level: levelWarn, Service: "api", Msg: "Down."},
+		{Level: levelError, Service: "api", Msg: "Still down after 3 restarts, giving up."},
+	}
+	decoder := json.NewDecoder(&out)
+	for _, w := range want {
+		var got logLine
+		if err := decoder.Decode(&got); err != nil {
+			t.Fatalf("decoding log line: %v", err)
+		}
+		if got.Level != w.Level || got.Service != w.Service || got.Msg != w.Msg {
+			t.Errorf("logged %+v, want level %q, service %q, msg %q", got, w.Level, w.Service, w.Msg)
+		}
+	}
+}
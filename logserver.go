@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/** Logging/Telemetry Server */
+
+const forwardTimeout = 5 * time.Second
+
+// forwardClient is shared by every forwarded log so connections to the
+// collector are reused rather than opened per message.
+var forwardClient = &http.Client{Timeout: forwardTimeout}
+
+// forwardedLog is the JSON body POSTed to the forward URL for each log.
+type forwardedLog struct {
+	Source   string     `json:"source"`
+	Received time.Time  `json:"received"`
+	Header   *logHeader `json:"header,omitempty"`
+	Message  string     `json:"message"`
+}
+
+// What -oversizeLogs does with logs over -maxLogMessageSize.
+const (
+	oversizeTruncate = "truncate"
+	oversizeDrop     = "drop"
+)
+
+// What -forwardOverflow does with UDP logs beyond -maxForwardInflight: wait
+// for one in flight to finish, or drop them.
+const (
+	forwardOverflowQueue = "queue"
+	forwardOverflowDrop  = "drop"
+)
+
+// What -logAck replies to each UDP log with: nothing, or a fixed ACK.
+const (
+	logAckOff = "off"
+	logAckOn  = "ack"
+)
+
+// logAckMessage is the reply to a UDP log sent without a header.
+var logAckMessage = []byte("ACK")
+
+// logHeaderSize is the length of the header that starts each UDP log packet
+// with -logHeader.
+const logHeaderSize = 3
+
+// logHeader is the DNS-like header of a UDP log packet:
+//
+//	0 - 1: ID
+//	2: QR(1): Opcode(4)
+//
+// The QR bit is set in replies.
+type logHeader struct {
+	ID     uint16 `json:"id"`
+	QR     bool   `json:"qr"`
+	Opcode uint8  `json:"opcode"`
+}
+
+// parseLogPacket splits a UDP log packet into its header and message.
+func parseLogPacket(packet []byte) (logHeader, []byte, error) {
+	if len(packet) < logHeaderSize {
+		return logHeader{}, nil, fmt.Errorf("packet of %d bytes is shorter than the %d byte header", len(packet), logHeaderSize)
+	}
+	header := logHeader{
+		ID:     binary.BigEndian.Uint16(packet[0:2]),
+		QR:     packet[2]&0x80 != 0,
+		Opcode: packet[2] >> 3 & 0x0f,
+	}
+	return header, packet[logHeaderSize:], nil
+}
+
+// logSinks are where received logs go: the -forward URLs, subject to each
+// source's rate limit, and the -logFile.
+type logSinks struct {
+	// queues send logs to each forward URL; there are none without -forward.
+	queues []*forwardQueue
+	stats  *sourceStats
+	// file is nil without -logFile.
+	file *rotatingFile
+	// batch collects logs for the forward URL when -forwardBatchSize is
+	// above 1; otherwise each log is POSTed on its own.
+	batch *logBatcher
+	// inflight holds a slot for each UDP log being handled; it is nil when
+	// -maxForwardInflight is 0. overflow is the -forwardOverflow policy for
+	// logs arriving while every slot is taken.
+	inflight chan struct{}
+	overflow string
+}
+
+// acquire takes an in-flight slot for a log from addr, waiting for one or
+// dropping the log as -forwardOverflow says, and reports whether it got one.
+func (s *logSinks) acquire(addr net.Addr) bool {
+	if s.inflight == nil {
+		return true
+	}
+	select {
+	case s.inflight <- struct{}{}:
+		return true
+	default:
+	}
+	if s.overflow == forwardOverflowDrop {
+		logWarn("Dropped log from %v, %d logs already in flight, see -maxForwardInflight.", addr, cap(s.inflight))
+		counters.logsInflightDropped.Add(1)
+		return false
+	}
+	counters.logsInflightQueued.Add(1)
+	s.inflight <- struct{}{}
+	return true
+}
+
+// release frees the slot taken by acquire.
+func (s *logSinks) release() {
+	if s.inflight != nil {
+		<-s.inflight
+	}
+}
+
+// sourceStats counts the log messages and bytes received from each source IP,
+// so "chatty" applications can be spotted, and rate-limits how many of their
+// messages are forwarded.
+type sourceStats struct {
+	mutex   sync.Mutex
+	sources map[string]*sourceCount
+	// threshold is the messages per second above which a source is warned
+	// about; zero disables the warning.
+	threshold int
+	// rate and burst configure each source's token bucket; a zero rate
+	// disables rate limiting.
+	rate  float64
+	burst int
+}
+
+type sourceCount struct {
+	Messages uint64    `json:"messages"`
+	Bytes    uint64    `json:"bytes"`
+	Dropped  uint64    `json:"dropped"`
+	Invalid  uint64    `json:"invalid"`
+	LastSeen time.Time `json:"lastSeen"`
+
+	window      time.Time
+	windowCount int
+
+	tokens   float64
+	refilled time.Time
+}
+
+func newSourceStats(config *daemonConfig) *sourceStats {
+	return &sourceStats{
+		sources:   make(map[string]*sourceCount),
+		threshold: config.chattyThreshold,
+		rate:      config.forwardRate,
+		burst:     config.forwardBurst,
+	}
+}
+
+// source returns the counts for addr's IP, creating them on first sight. The
+// caller must hold s.mutex.
+func (s *sourceStats) source(addr net.Addr) (string, *sourceCount) {
+	source := addr.String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	count, ok := s.sources[source]
+	if !ok {
+		count = &sourceCount{tokens: float64(s.burst), refilled: time.Now()}
+		s.sources[source] = count
+	}
+	return source, count
+}
+
+// record counts a message of size bytes from addr, warning once per second
+// while the source is over the threshold.
+func (s *sourceStats) record(addr net.Addr, size int) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	source, count := s.source(addr)
+	count.Messages++
+	count.Bytes += uint64(size)
+	count.LastSeen = now
+
+	if now.Sub(count.window) >= time.Second {
+		count.window = now
+		count.windowCount = 0
+	}
+	count.windowCount++
+	if s.threshold > 0 && count.windowCount == s.threshold+1 {
+		logWarn("%v is chatty: more than %d log messages in the last second.", source, s.threshold)
+	}
+}
+
+// reject counts a packet from addr that couldn't be parsed.
+func (s *sourceStats) reject(addr net.Addr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, count := s.source(addr)
+	count.Invalid++
+}
+
+// allow takes a token from addr's bucket and reports whether its message may be
+// forwarded. Messages over the limit are counted as dropped.
+func (s *sourceStats) allow(addr net.Addr) bool {
+	if s.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, count := s.source(addr)
+	count.tokens += now.Sub(count.refilled).Seconds() * s.rate
+	if max := float64(s.burst); count.tokens > max {
+		count.tokens = max
+	}
+	count.refilled = now
+
+	if count.tokens < 1 {
+		count.Dropped++
+		return false
+	}
+	count.tokens--
+	return true
+}
+
+// snapshot returns a copy of the per-source counts.
+func (s *sourceStats) snapshot() map[string]sourceCount {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counts := make(map[string]sourceCount, len(s.sources))
+	for source, count := range s.sources {
+		counts[source] = *count
+	}
+	return counts
+}
+
+func startLogServer(ctx context.Context, config *daemonConfig, sinks *logSinks) error {
+	log.Println("Starting UDP log service.")
+	conn, err := listenLogSocket(logNetwork("udp", config.bind), net.JoinHostPort(config.bind, strconv.Itoa(config.port)))
+	if err != nil {
+		logError("Failed to start log service.")
+		return err
+	}
+
+	defer conn.Close()
+	setLogSocket(conn)
+	defer setLogSocket(nil)
+	liveness.logServers.Add(1)
+	defer liveness.logServers.Add(-1)
+
+	// Closing the connection unblocks ReadFrom so the loop below can return.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, config.logBufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("UDP log service stopped.")
+				return nil
+			}
+			continue
+		}
+		if n == len(buf) {
+			logWarn("Log from %v may have been truncated at %d bytes, see -logBufferSize.", addr, n)
+		}
+		// buf is reused for the next packet, so hand over a copy of what was read.
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		receivePacket(conn, addr, addr, msg, config, sinks)
+	}
+}
+
+// receivePacket handles a log packet read from conn: it checks its header and
+// size, then acknowledges and forwards it on a goroutine of its own. The log
+// is attributed to source; acknowledgements go to peer, and there are none
+// when peer is nil.
+func receivePacket(conn net.PacketConn, source, peer net.Addr, msg []byte, config *daemonConfig, sinks *logSinks) {
+	sinks.stats.record(source, len(msg))
+	var header *logHeader
+	if config.logHeader {
+		parsed, payload, err := parseLogPacket(msg)
+		if err != nil {
+			logWarn("Rejected log from %v: %v.", source, err)
+			sinks.stats.reject(source)
+			counters.logsInvalid.Add(1)
+			return
+		}
+		header, msg = &parsed, payload
+	}
+	msg, ok := limitSize(source, msg, config)
+	if !ok {
+		return
+	}
+	// Each log is handled on its own goroutine, but only so many at once so
+	// a burst can't run the daemon out of sockets.
+	if !sinks.acquire(source) {
+		return
+	}
+	go func() {
+		defer sinks.release()
+		if config.logAck == logAckOn && peer != nil {
+			acknowledgeLog(conn, peer, header)
+		}
+		forwardLog(source, header, msg, sinks)
+	}()
+}
+
+// logNetwork narrows network ("udp" or "tcp") to IPv4 or IPv6 to match the
+// bind address. Without one, both are accepted.
+func logNetwork(network, bind string) string {
+	ip := net.ParseIP(bind)
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return network + "4"
+	default:
+		return network + "6"
+	}
+}
+
+// startTCPLogServer accepts newline-delimited logs over TCP, which unlike UDP
+// doesn't drop messages under load. Every line goes through forwardLog just
+// like a UDP packet.
+func startTCPLogServer(ctx context.Context, config *daemonConfig, sinks *logSinks) error {
+	log.Println("Starting TCP log service.")
+	listener, err := net.Listen(logNetwork("tcp", config.bind), net.JoinHostPort(config.bind, strconv.Itoa(config.tcpPort)))
+	if err != nil {
+		logError("Failed to start TCP log service.")
+		return err
+	}
+	liveness.logServers.Add(1)
+	defer liveness.logServers.Add(-1)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("TCP log service stopped.")
+				return nil
+			}
+			continue
+		}
+		go readLogLines(ctx, conn, config, sinks)
+	}
+}
+
+// startUnixLogServer accepts logs as datagrams on the Unix socket at
+// -unixSocket, handling each just like a UDP packet. The socket file is
+// removed again when the service stops.
+func startUnixLogServer(ctx context.Context, config *daemonConfig, sinks *logSinks) error {
+	log.Println("Starting Unix socket log service.")
+	if err := removeStaleSocket(config.unixSocket); err != nil {
+		logError("Failed to start Unix socket log service.")
+		return err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: config.unixSocket, Net: "unixgram"})
+	if err != nil {
+		logError("Failed to start Unix socket log service.")
+		return err
+	}
+	defer os.Remove(config.unixSocket)
+	defer conn.Close()
+	liveness.logServers.Add(1)
+	defer liveness.logServers.Add(-1)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, config.logBufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("Unix socket log service stopped.")
+				return nil
+			}
+			continue
+		}
+		// Senders rarely bind a socket of their own, so their logs are
+		// attributed to the daemon's. They can't be replied to either:
+		// replying to the daemon's own socket would read the reply back as a
+		// log.
+		source, peer := addr, addr
+		if unix, ok := addr.(*net.UnixAddr); !ok || unix == nil || unix.Name == "" {
+			source, peer = conn.LocalAddr(), nil
+		}
+		if n == len(buf) {
+			logWarn("Log from %v may have been truncated at %d bytes, see -logBufferSize.", source, n)
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		receivePacket(conn, source, peer, msg, config, sinks)
+	}
+}
+
+// removeStaleSocket removes a socket left at path by a daemon that didn't shut
+// down cleanly. Anything else at path is left alone and reported.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and isn't a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// readLogLines forwards each line read from conn until it is closed.
+func readLogLines(ctx context.Context, conn net.Conn, config *daemonConfig, sinks *logSinks) {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), config.logBufferSize)
+	for scanner.Scan() {
+		msg := make([]byte, len(scanner.Bytes()))
+		copy(msg, scanner.Bytes())
+		sinks.stats.record(conn.RemoteAddr(), len(msg))
+		msg, ok := limitSize(conn.RemoteAddr(), msg, config)
+		if !ok {
+			continue
+		}
+		forwardLog(conn.RemoteAddr(), nil, msg, sinks)
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		logError("Failed to read logs from %v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// limitSize applies -maxLogMessageSize to msg from addr, returning it
+// truncated if need be, and whether it should be forwarded at all.
+func limitSize(addr net.Addr, msg []byte, config *daemonConfig) ([]byte, bool) {
+	if config.maxLogMessageSize == 0 || len(msg) <= config.maxLogMessageSize {
+		return msg, true
+	}
+	if config.oversizeLogs == oversizeDrop {
+		logWarn("Dropped %d byte log from %v, see -maxLogMessageSize.", len(msg), addr)
+		counters.logsOversize.Add(1)
+		return nil, false
+	}
+	logWarn("Truncated %d byte log from %v to %d bytes, see -maxLogMessageSize.", len(msg), addr, config.maxLogMessageSize)
+	counters.logsTruncated.Add(1)
+	return msg[:config.maxLogMessageSize], true
+}
+
+// acknowledgeLog replies to the sender of a UDP log without echoing any of it
+// back: a log sent with a header gets the header back with the QR bit set, any
+// other log a fixed ACK.
+func acknowledgeLog(conn net.PacketConn, addr net.Addr, header *logHeader) {
+	reply := logAckMessage
+	if header != nil {
+		reply = make([]byte, logHeaderSize)
+		binary.BigEndian.PutUint16(reply[0:2], header.ID)
+		reply[2] = 0x80 | header.Opcode<<3
+	}
+	conn.WriteTo(reply, addr)
+}
+
+// forwardLog logs a single message, appends it to the log file and forwards it
+// to every forward URL, unless its source is over its rate limit. msg must hold
+// only the bytes actually read, not the whole read buffer, so no NUL padding
+// leaks into the log or the forwarded payload. header is nil for logs sent
+// without one.
+func forwardLog(addr net.Addr, header *logHeader, msg []byte, sinks *logSinks) {
+	if header != nil {
+		log.Printf("Log received from %v (id %d, opcode %d): %q", addr, header.ID, header.Opcode, msg)
+	} else {
+		log.Printf("Log received from %v: %q", addr, msg)
+	}
+
+	entry := forwardedLog{Source: addr.String(), Received: time.Now(), Header: header, Message: string(msg)}
+	if sinks.file != nil {
+		if err := sinks.file.writeJSON(entry); err != nil {
+			logError("Failed to write log from %v to %v: %v", addr, sinks.file.path, err)
+		}
+	}
+	if len(sinks.queues) > 0 {
+		if !sinks.stats.allow(addr) {
+			return
+		}
+		if sinks.batch != nil {
+			sinks.batch.add(entry)
+			return
+		}
+		for _, queue := range sinks.queues {
+			queue.push(entry, 1)
+		}
+	}
+}
+
+// postJSON sends v to forwardURL as JSON.
+func postJSON(forwardURL string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return postBody(forwardURL, body, "")
+}
+
+// postGzipJSON sends v to forwardURL as gzipped JSON.
+func postGzipJSON(forwardURL string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(body); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return postBody(forwardURL, compressed.Bytes(), "gzip")
+}
+
+// postBody POSTs a JSON body to forwardURL, with the given Content-Encoding
+// unless it is empty.
+func postBody(forwardURL string, body []byte, encoding string) error {
+	req, err := http.NewRequest(http.MethodPost, forwardURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	res, err := forwardClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("forward URL responded %v", res.Status)
+	}
+	return nil
+}
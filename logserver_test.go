@@ -0,0 +1,130 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogNetwork(t *testing.T) {
+	tests := []struct {
+		network, bind, want string
+	}{
+		{"udp", "", "udp"},
+		{"tcp", "", "tcp"},
+		{"udp", "127.0.0.1", "udp4"},
+		{"tcp", "0.0.0.0", "tcp4"},
+		{"udp", "::1", "udp6"},
+		{"tcp", "::", "tcp6"},
+	}
+	for _, test := range tests {
+		if got := logNetwork(test.network, test.bind); got != test.want {
+			t.Errorf("logNetwork(%q, %q) = %q, want %q", test.network, test.bind, got, test.want)
+		}
+	}
+}
+
+// TestLogServerBind checks that -bind=127.0.0.1 has the UDP log service listen
+// on the loopback address only, and that logs sent there are received.
+func TestLogServerBind(t *testing.T) {
+	config := &daemonConfig{}
+	if err := config.loadConfig([]string{"daemon", "-allowEmptyRegistry", "-bind=127.0.0.1"}); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	// Any free port will do.
+	config.port = 0
+	sinks := &logSinks{stats: newSourceStats(config)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- startLogServer(ctx, config, sinks)
+	}()
+	defer func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("startLogServer: %v", err)
+		}
+	}()
+
+	var addr *net.UDPAddr
+	for deadline := time.Now().Add(time.Second); addr == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("UDP log service didn't start")
+		}
+		logSocket.mutex.Lock()
+		if logSocket.conn != nil {
+			addr = logSocket.conn.LocalAddr().(*net.UDPAddr)
+		}
+		logSocket.mutex.Unlock()
+	}
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("log service listens on %v, want 127.0.0.1", addr)
+	}
+
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if sinks.stats.snapshot()["127.0.0.1"].Messages == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log sent to 127.0.0.1 wasn't received")
+		}
+	}
+}
+
+// TestPostGzipJSON checks that a gzipped batch arrives marked as gzip and
+// decompresses back to what was sent.
+func TestPostGzipJSON(t *testing.T) {
+	batch := []forwardedLog{
+		{Source: "127.0.0.1:4000", Received: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Message: "first"},
+		{Source: "127.0.0.1:4001", Received: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC), Header: &logHeader{ID: 7, QR: true, Opcode: 2}, Message: "second"},
+	}
+
+	received := make(chan []forwardedLog, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("Content-Encoding = %q, want gzip", got)
+		}
+		if got := req.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Errorf("body isn't gzipped: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Errorf("can't decompress body: %v", err)
+		}
+		var logs []forwardedLog
+		if err := json.Unmarshal(body, &logs); err != nil {
+			t.Errorf("decompressed body isn't a JSON batch: %v", err)
+		}
+		received <- logs
+	}))
+	defer server.Close()
+
+	if err := postGzipJSON(server.URL, batch); err != nil {
+		t.Fatalf("postGzipJSON: %v", err)
+	}
+	if got := <-received; !reflect.DeepEqual(got, batch) {
+		t.Errorf("collector received %+v, want %+v", got, batch)
+	}
+}
@@ -1,20 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/yaml.v3"
 )
 
 /**
@@ -30,7 +46,56 @@ on failed healthchecks, update/patch registry
 attempt to restart failing applications (if in config)
 */
 
-const defaultTick = 2 * time.Second
+const (
+	defaultTick             = 2 * time.Second
+	defaultHealthTimeout    = 5 * time.Second
+	defaultHealthRetries    = 3
+	defaultHealthBackoff    = 1 * time.Second
+	maxHealthBackoff        = 30 * time.Second
+	maxHealthBodySize       = 64 * 1024
+	defaultSaveInterval     = 30 * time.Second
+	defaultMaxRestarts      = 5
+	defaultRestartBackoff   = 1 * time.Second
+	maxRestartBackoff       = 5 * time.Minute
+	defaultShutdownGrace    = 10 * time.Second
+	defaultLogBufferSize    = 64 * 1024
+	defaultForwardBurst     = 20
+	defaultLogFileMaxSize   = 10 * 1024 * 1024
+	defaultLogFileBackups   = 5
+	defaultFlushInterval    = 1 * time.Second
+	defaultForwardRetries   = 3
+	defaultForwardQueue     = 1000
+	defaultForwardInflight  = 100
+	defaultFailThreshold    = 3
+	defaultRecoverThreshold = 2
+	defaultHealthJitter     = 0.1
+	defaultHistorySize      = 20
+	defaultAlertAfter       = 1 * time.Minute
+	defaultEventSubscribers = 10
+
+	// Health checks keep a few idle connections open to each service.
+	healthMaxIdleConns        = 100
+	healthMaxIdleConnsPerHost = 4
+	healthIdleConnTimeout     = 90 * time.Second
+)
+
+// What -checkMode can be, and the pause between one application's check and
+// the next in a sequential sweep.
+const (
+	checkParallel      = "parallel"
+	checkSequential    = "sequential"
+	sequentialCheckGap = 100 * time.Millisecond
+)
+
+// Build info, set at link time with e.g.
+// -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD)".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// daemonStarted is when the daemon process started.
+var daemonStarted = time.Now()
 
 type daemonConfig struct {
 	monitoring bool
@@ -38,13 +103,122 @@ type daemonConfig struct {
 	interval   time.Duration
 	metrics    bool
 	restart    bool
-	forward    string
+	forward    urlList
 	appFile    string
+	// eventURL receives application state changes, defaulting to the first
+	// forward URL.
+	eventURL string
+	// maxEventSubscribers caps how many clients can stream /events.
+	maxEventSubscribers int
+
+	// alertURL is sent an alert once an application has been down for
+	// alertAfter, again every realertInterval if set, and once it recovers.
+	alertURL        string
+	alertAfter      time.Duration
+	realertInterval time.Duration
+
+	// selfHeartbeat is how often the daemon tells selfHeartbeatURL it is alive.
+	selfHeartbeat    time.Duration
+	selfHeartbeatURL string
+
+	// skipInvalid logs and leaves out invalid entries in appFile instead of
+	// refusing to start.
+	skipInvalid bool
+	// watch reloads appFile whenever it changes on disk.
+	watch bool
+	// allowEmptyRegistry starts with no applications, instead of refusing
+	// to, when appFile is missing or empty.
+	allowEmptyRegistry bool
+
+	healthTimeout time.Duration
+	healthRetries int
+	healthBackoff time.Duration
+	// healthBackoffStrategy names the backoffStrategies entry that spaces
+	// out health-check retries.
+	healthBackoffStrategy string
+	// userAgent is sent with every HTTP and gRPC health check.
+	userAgent string
+
+	failThreshold    int
+	recoverThreshold int
+	healthJitter     float64
+	historySize      int
+
+	maxConcurrentChecks int
+	// checkMode is checkParallel or checkSequential.
+	checkMode string
+
+	stateFile    string
+	saveInterval time.Duration
+
+	apiPort int
+
+	maxRestarts    int
+	restartBackoff time.Duration
+	noStart        bool
+	shutdownGrace  time.Duration
+	// once checks every application a single time and exits.
+	once bool
+	// restartDryRun logs the restarts -restart would make instead of making
+	// them.
+	restartDryRun bool
+	// startupTimeout bounds starting the applications and waiting for them
+	// to become healthy.
+	startupTimeout time.Duration
+	// startDelay is how long to wait after loading before the first health
+	// checks, so services started alongside the daemon can come up.
+	startDelay time.Duration
+
+	// logServer accepts UDP logs on port. It is on when asked for with
+	// -logServer or when -port is set explicitly.
+	logFormat     string
+	logServer     bool
+	logHeader     bool
+	logAck        string
+	logBufferSize int
+	tcpPort       int
+	// unixSocket is the path of a Unix datagram socket to accept logs on,
+	// if any.
+	unixSocket string
+	// bind is the address the log services listen on; empty means all of
+	// them, IPv4 and IPv6.
+	bind string
+
+	// Logs longer than maxLogMessageSize bytes are truncated to it or, with
+	// oversizeLogs=drop, dropped. Zero means no limit.
+	maxLogMessageSize int
+	oversizeLogs      string
+
+	// logFile receives every log as a JSON line, rotated once it grows past
+	// logFileMaxSize bytes, keeping logFileBackups old files.
+	logFile        string
+	logFileMaxSize int64
+	logFileBackups int
+
+	chattyThreshold int
+	forwardRate     float64
+	forwardBurst    int
+
+	// Logs are forwarded in batches of up to forwardBatchSize, sent at least
+	// every forwardFlushInterval, and gzipped with forwardGzip.
+	forwardBatchSize     int
+	forwardFlushInterval time.Duration
+	forwardGzip          bool
+
+	// Failed forwards are retried forwardRetries times while up to
+	// forwardQueueSize more wait behind them.
+	forwardRetries   int
+	forwardQueueSize int
+
+	// At most maxForwardInflight UDP logs are handled at once; forwardOverflow
+	// says whether the rest are dropped or wait. Zero means no limit.
+	maxForwardInflight int
+	forwardOverflow    string
 }
 
 func (config *daemonConfig) loadConfig(args []string) error {
 	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
-	flags.String("I", "", "./config.conf")
+	configFile := flags.String("I", "", "Config file of key=value lines named after the flags, e.g. ./config.conf")
 
 	var (
 		monitoring = flags.Bool("monitoring", false, "Monitoring")
@@ -52,13 +226,96 @@ func (config *daemonConfig) loadConfig(args []string) error {
 		interval   = flags.Duration("Interval", defaultTick, "Interval for monitoring requests")
 		metrics    = flags.Bool("metrics", false, "Collect metrics")
 		restart    = flags.Bool("restart", false, "Restart on failure")
-		forward    = flags.String("forward", "", "Forward UDP logs to url") // -forward=http://localhost:6000/logs
-		appFile    = flags.String("appFile", "", "Application list file")
+		forward    = new(urlList)
+		appFile    = flags.String("appFile", "", "Application list file, or a directory of them")
+		eventURL   = flags.String("eventURL", "", "POST application state changes to url (defaults to the first -forward)")
+
+		maxEventSubscribers = flags.Int("maxEventSubscribers", defaultEventSubscribers, "Most clients that may stream /events at once")
+
+		alertURL        = flags.String("alertURL", "", "POST an alert to url when an application stays down for -alertAfter")
+		alertAfter      = flags.Duration("alertAfter", defaultAlertAfter, "Time an application must be down for before alerting")
+		realertInterval = flags.Duration("realertInterval", 0, "Repeat the alert this often while an application stays down (0 to alert once)")
+
+		selfHeartbeat    = flags.Duration("selfHeartbeat", 0, "Interval for POSTing a daemon alive ping to -selfHeartbeatURL (0 to disable)")
+		selfHeartbeatURL = flags.String("selfHeartbeatURL", "", "URL of an external watchdog for the daemon's own heartbeat")
+
+		skipInvalid = flags.Bool("skipInvalid", false, "Skip invalid entries in the application file instead of failing to start")
+		watch       = flags.Bool("watch", false, "Reload the application file whenever it changes, as on SIGHUP")
+
+		allowEmptyRegistry = flags.Bool("allowEmptyRegistry", false, "Start with no applications if the application file is missing or empty, to register them later over the API")
+
+		healthTimeout = flags.Duration("healthTimeout", defaultHealthTimeout, "Timeout for a single health-check request")
+		healthRetries = flags.Int("healthRetries", defaultHealthRetries, "Health-check attempts before a service is marked down")
+		healthBackoff = flags.Duration("healthBackoff", defaultHealthBackoff, "Base delay between health-check attempts, see -healthBackoffStrategy")
+		userAgent     = flags.String("userAgent", "LittleDaemons/"+version, "User-Agent sent with health checks")
+
+		healthBackoffStrategy = flags.String("healthBackoffStrategy", "exponential", "How the delay between health-check attempts grows: "+strings.Join(backoffStrategyNames(), ", "))
+
+		failThreshold    = flags.Int("failThreshold", defaultFailThreshold, "Consecutive failed checks before a degraded service is marked down")
+		recoverThreshold = flags.Int("recoverThreshold", defaultRecoverThreshold, "Consecutive successful checks before a failing service is marked up again")
+		healthJitter     = flags.Float64("healthJitter", defaultHealthJitter, "Fraction of the interval health checks are randomly spread by")
+		historySize      = flags.Int("historySize", defaultHistorySize, "Recent health-check results kept per application")
+
+		maxConcurrentChecks = flags.Int("maxConcurrentChecks", 0, "Most health checks run at the same time (0 for no limit)")
+		checkMode           = flags.String("checkMode", checkParallel, "Check applications in parallel, or in a sequential sweep one after another")
+
+		stateFile    = flags.String("stateFile", "", "File the registry state is persisted to between runs")
+		saveInterval = flags.Duration("saveInterval", defaultSaveInterval, "Interval for persisting registry state")
+
+		apiPort = flags.Int("apiPort", 0, "TCP port for the HTTP status API (defaults to -port)")
+
+		maxRestarts    = flags.Int("maxRestarts", defaultMaxRestarts, "Restart attempts per failure before giving up (0 for unlimited)")
+		restartBackoff = flags.Duration("restartBackoff", defaultRestartBackoff, "Base delay between restart attempts, doubled on each attempt")
+		noStart        = flags.Bool("noStart", false, "Only monitor applications, never start them")
+		restartDryRun  = flags.Bool("restartDryRun", false, "Log the restarts -restart would make without making them")
+		startupTimeout = flags.Duration("startupTimeout", 0, "Longest starting applications and waiting for them to be healthy may take (0 for no limit)")
+		startDelay     = flags.Duration("startDelay", 0, "Time to wait after loading before the first health checks")
+		once           = flags.Bool("once", false, "Health-check every application once, print a summary and exit non-zero if any is down")
+		shutdownGrace  = flags.Duration("shutdownGrace", defaultShutdownGrace, "Time started applications get to exit after SIGTERM before being killed")
+
+		logFormat     = flags.String("logFormat", logFormatText, "Format of the daemon's own log: text or json")
+		logServer     = flags.Bool("logServer", false, "Accept UDP logs on -port (implied when -port is set)")
+		logHeader     = flags.Bool("logHeader", false, "UDP log packets start with a 3 byte ID/QR/opcode header")
+		logAck        = flags.String("logAck", logAckOff, "Reply to each UDP log: off, or ack for a fixed acknowledgement")
+		logBufferSize = flags.Int("logBufferSize", defaultLogBufferSize, "Largest log packet in bytes; anything bigger is truncated")
+		tcpPort       = flags.Int("tcpPort", 0, "Also accept newline-delimited logs over TCP on this port")
+		unixSocket    = flags.String("unixSocket", "", "Also accept logs as datagrams on a Unix socket at this path")
+		bind          = flags.String("bind", "", "Address the log services listen on, IPv4 or IPv6 (all addresses when empty)")
+
+		maxLogMessageSize = flags.Int("maxLogMessageSize", 0, "Longest log message in bytes that is forwarded as is (0 for no limit)")
+		oversizeLogs      = flags.String("oversizeLogs", oversizeTruncate, "What to do with logs over -maxLogMessageSize: truncate or drop")
+
+		logFile        = flags.String("logFile", "", "Append received logs to this file as JSON lines")
+		logFileMaxSize = flags.Int64("logFileMaxSize", defaultLogFileMaxSize, "Size in bytes at which -logFile is rotated")
+		logFileBackups = flags.Int("logFileBackups", defaultLogFileBackups, "Rotated log files to keep")
+
+		chattyThreshold = flags.Int("chattyThreshold", 0, "Warn when a single source sends more log messages per second than this (0 to disable)")
+		forwardRate     = flags.Float64("forwardRate", 0, "Log messages per second forwarded for each source, the rest are dropped (0 for unlimited)")
+		forwardBurst    = flags.Int("forwardBurst", defaultForwardBurst, "Log messages a source may send in a burst above -forwardRate")
+
+		forwardBatchSize     = flags.Int("forwardBatchSize", 1, "Forward logs as JSON arrays of up to this many messages (1 sends each on its own)")
+		forwardFlushInterval = flags.Duration("forwardFlushInterval", defaultFlushInterval, "Longest a batched log waits before being forwarded")
+		forwardGzip          = flags.Bool("forwardGzip", false, "Gzip forwarded logs and send them with Content-Encoding: gzip")
+
+		forwardRetries   = flags.Int("forwardRetries", defaultForwardRetries, "Retries, with exponential backoff, of a failed log forward")
+		forwardQueueSize = flags.Int("forwardQueueSize", defaultForwardQueue, "Forwards held while the collector is slow or down; the oldest are dropped beyond this")
+
+		maxForwardInflight = flags.Int("maxForwardInflight", defaultForwardInflight, "UDP logs handled at once (0 for no limit)")
+		forwardOverflow    = flags.String("forwardOverflow", forwardOverflowQueue, "What to do with UDP logs beyond -maxForwardInflight: queue or drop")
 	)
+	flags.Var(forward, "forward", "Forward UDP logs to url; repeat it or give a comma-separated list to forward to several") // -forward=http://localhost:6000/logs
 
 	if err := flags.Parse(args[1:]); err != nil {
 		return err
 	}
+	if err := loadConfigEnv(flags); err != nil {
+		return err
+	}
+	if *configFile != "" {
+		if err := loadConfigFile(flags, *configFile); err != nil {
+			return err
+		}
+	}
 
 	config.monitoring = *monitoring
 	config.port = *port
@@ -67,220 +324,1841 @@ func (config *daemonConfig) loadConfig(args []string) error {
 	config.restart = *restart
 	config.forward = *forward
 	config.appFile = *appFile
+	config.eventURL = *eventURL
+	config.maxEventSubscribers = *maxEventSubscribers
+	config.alertURL = *alertURL
+	config.alertAfter = *alertAfter
+	config.realertInterval = *realertInterval
+	config.selfHeartbeat = *selfHeartbeat
+	config.selfHeartbeatURL = *selfHeartbeatURL
+	config.skipInvalid = *skipInvalid
+	config.watch = *watch
+	config.allowEmptyRegistry = *allowEmptyRegistry
+	config.healthTimeout = *healthTimeout
+	config.healthRetries = *healthRetries
+	config.healthBackoff = *healthBackoff
+	config.healthBackoffStrategy = *healthBackoffStrategy
+	config.userAgent = *userAgent
+	config.failThreshold = *failThreshold
+	config.recoverThreshold = *recoverThreshold
+	config.healthJitter = *healthJitter
+	config.historySize = *historySize
+	config.maxConcurrentChecks = *maxConcurrentChecks
+	config.checkMode = *checkMode
+	config.stateFile = *stateFile
+	config.saveInterval = *saveInterval
+	config.apiPort = *apiPort
+	config.maxRestarts = *maxRestarts
+	config.restartBackoff = *restartBackoff
+	config.noStart = *noStart
+	config.restartDryRun = *restartDryRun
+	config.startupTimeout = *startupTimeout
+	config.startDelay = *startDelay
+	config.once = *once
+	config.shutdownGrace = *shutdownGrace
+	config.logFormat = *logFormat
+	config.logServer = *logServer
+	config.logHeader = *logHeader
+	config.logAck = *logAck
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			config.logServer = true
+		}
+	})
+	config.logBufferSize = *logBufferSize
+	config.tcpPort = *tcpPort
+	config.unixSocket = *unixSocket
+	config.bind = *bind
+	config.maxLogMessageSize = *maxLogMessageSize
+	config.oversizeLogs = *oversizeLogs
+	config.logFile = *logFile
+	config.logFileMaxSize = *logFileMaxSize
+	config.logFileBackups = *logFileBackups
+	config.chattyThreshold = *chattyThreshold
+	config.forwardRate = *forwardRate
+	config.forwardBurst = *forwardBurst
+	config.forwardBatchSize = *forwardBatchSize
+	config.forwardFlushInterval = *forwardFlushInterval
+	config.forwardGzip = *forwardGzip
+	config.forwardRetries = *forwardRetries
+	config.forwardQueueSize = *forwardQueueSize
+	config.maxForwardInflight = *maxForwardInflight
+	config.forwardOverflow = *forwardOverflow
 
-	log.Println("Config")
-	fmt.Printf("%+v\n", config)
+	return config.validate()
+}
+
+// print dumps config to the log.
+func (config *daemonConfig) print() {
+	log.Printf("Config: %+v", config)
+}
 
-	// TODO(moosch): Create new log.Logger for each application.
+// validate rejects settings that would otherwise only fail once the daemon is
+// running.
+func (config *daemonConfig) validate() error {
+	if config.logFormat != logFormatText && config.logFormat != logFormatJSON {
+		return fmt.Errorf("-logFormat must be %v or %v, got %q", logFormatText, logFormatJSON, config.logFormat)
+	}
+	if config.checkMode != checkParallel && config.checkMode != checkSequential {
+		return fmt.Errorf("-checkMode must be %v or %v, got %q", checkParallel, checkSequential, config.checkMode)
+	}
+	if _, ok := backoffStrategies[config.healthBackoffStrategy]; !ok {
+		return fmt.Errorf("-healthBackoffStrategy must be one of %v, got %q", strings.Join(backoffStrategyNames(), ", "), config.healthBackoffStrategy)
+	}
+	if config.interval <= 0 {
+		return fmt.Errorf("-Interval must be positive, got %v", config.interval)
+	}
+	if config.healthJitter < 0 || config.healthJitter >= 1 {
+		return fmt.Errorf("-healthJitter must be at least 0 and below 1, got %v", config.healthJitter)
+	}
+	if config.stateFile != "" && config.saveInterval <= 0 {
+		return fmt.Errorf("-saveInterval must be positive, got %v", config.saveInterval)
+	}
+	if config.port < 1 || config.port > 65535 {
+		return fmt.Errorf("-port must be between 1 and 65535, got %d", config.port)
+	}
+	if config.apiPort < 0 || config.apiPort > 65535 {
+		return fmt.Errorf("-apiPort must be between 1 and 65535, got %d", config.apiPort)
+	}
+	if config.tcpPort < 0 || config.tcpPort > 65535 {
+		return fmt.Errorf("-tcpPort must be between 1 and 65535, got %d", config.tcpPort)
+	}
+	for _, forward := range config.forward {
+		if err := validateURL("-forward", forward); err != nil {
+			return err
+		}
+	}
+	if config.forwardBatchSize > 1 && config.forwardFlushInterval <= 0 {
+		return fmt.Errorf("-forwardFlushInterval must be positive, got %v", config.forwardFlushInterval)
+	}
+	if config.bind != "" && net.ParseIP(config.bind) == nil {
+		return fmt.Errorf("-bind must be an IP address, got %q", config.bind)
+	}
+	if config.startDelay < 0 {
+		return fmt.Errorf("-startDelay can't be negative, got %v", config.startDelay)
+	}
+	if config.logBufferSize <= 0 {
+		return fmt.Errorf("-logBufferSize must be positive, got %d", config.logBufferSize)
+	}
+	if config.maxLogMessageSize < 0 {
+		return fmt.Errorf("-maxLogMessageSize can't be negative, got %d", config.maxLogMessageSize)
+	}
+	if config.logAck != logAckOff && config.logAck != logAckOn {
+		return fmt.Errorf("-logAck must be %v or %v, got %q", logAckOff, logAckOn, config.logAck)
+	}
+	if config.oversizeLogs != oversizeTruncate && config.oversizeLogs != oversizeDrop {
+		return fmt.Errorf("-oversizeLogs must be %v or %v, got %q", oversizeTruncate, oversizeDrop, config.oversizeLogs)
+	}
+	if config.maxForwardInflight < 0 {
+		return fmt.Errorf("-maxForwardInflight can't be negative, got %d", config.maxForwardInflight)
+	}
+	if config.forwardOverflow != forwardOverflowQueue && config.forwardOverflow != forwardOverflowDrop {
+		return fmt.Errorf("-forwardOverflow must be %v or %v, got %q", forwardOverflowQueue, forwardOverflowDrop, config.forwardOverflow)
+	}
+	if err := validateURL("-eventURL", config.eventURL); err != nil {
+		return err
+	}
+	if err := validateURL("-alertURL", config.alertURL); err != nil {
+		return err
+	}
+	if err := validateURL("-selfHeartbeatURL", config.selfHeartbeatURL); err != nil {
+		return err
+	}
+	if config.selfHeartbeat > 0 && config.selfHeartbeatURL == "" {
+		return fmt.Errorf("-selfHeartbeat needs a -selfHeartbeatURL to send to")
+	}
+	return nil
+}
 
+// validateURL checks that value, if set, is an http or https URL.
+func validateURL(flag, value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%v is not a valid URL: %w", flag, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%v must be an http or https URL, got %q", flag, value)
+	}
 	return nil
 }
 
-type serviceName string
+// urlList is a flag that can be given several times, each time with one URL
+// or a comma-separated list of them.
+type urlList []string
 
-type application struct {
-	ServiceName  serviceName // "name": "NodeAPI",
-	ServiceURL   string      // "url": "http://localhost",
-	HeartbeatURL string      // "healthcheckURL": "/healthcheck",
-	Runtime      string      // "runtime": "node",
-	AppPath      string      // "path": "./node-app.js",
-	Args         string      // "args": "--NODE_ENV=production",
-	Port         int         // "port": 8080
+func (l *urlList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
 }
 
-type registry struct {
-	applications []application
-	mutex        *sync.RWMutex
+func (l *urlList) Set(value string) error {
+	for _, u := range strings.Split(value, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			*l = append(*l, u)
+		}
+	}
+	return nil
 }
 
-func (r *registry) loadApplications(filepath string) error {
-	content, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		log.Printf("Failed to load app list from %v.", filepath)
-		return err
-	}
+// loadConfigEnv sets every flag that wasn't given on the command line from its
+// DAEMON_ environment variable, e.g. DAEMON_PORT for -port or DAEMON_APPFILE
+// for -appFile.
+func loadConfigEnv(flags *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "I" {
+			return
+		}
+		name := "DAEMON_" + strings.ToUpper(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%v: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
 
-	var applications []application
-	err = json.Unmarshal(content, &applications)
+// loadConfigFile sets every flag named in file that wasn't given on the
+// command line or in the environment, so both override the file. Each line is
+// a key=value pair, with keys matched to flags regardless of case; blank lines
+// and lines starting with # are ignored.
+func loadConfigFile(flags *flag.FlagSet, file string) error {
+	content, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Printf("Invalid app list from %v.", filepath)
-		return err
+		return fmt.Errorf("can't read config file: %w", err)
 	}
 
-	r.applications = applications
-	log.Println("Applications")
-	fmt.Printf("%+v\n", applications)
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	names := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		names[strings.ToLower(f.Name)] = f.Name
+	})
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%v line %d: expected key=value", file, i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		name, ok := names[strings.ToLower(key)]
+		if !ok || name == "I" {
+			return fmt.Errorf("%v line %d: unknown setting %q", file, i+1, key)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%v line %d: %w", file, i+1, err)
+		}
+	}
 	return nil
 }
 
-func (r *registry) add(reg application) {
-	r.mutex.Lock()
-	r.applications = append(r.applications, reg)
-	r.mutex.Unlock()
+type serviceName string
+
+type application struct {
+	ServiceName  serviceName `json:"name"`                // "name": "NodeAPI",
+	ServiceURL   string      `json:"url"`                 // "url": "http://localhost",
+	HeartbeatURL string      `json:"healthcheckURL"`      // "healthcheckURL": "/healthcheck",
+	Runtime      string      `json:"runtime"`             // "runtime": "node",
+	AppPath      string      `json:"path"`                // "path": "./node-app.js",
+	Args         arguments   `json:"args,omitempty"`      // "args": "--NODE_ENV=production",
+	Port         int         `json:"port"`                // "port": 8080
+	Interval     duration    `json:"interval,omitempty"`  // "interval": "30s"
+	CheckType    checkType   `json:"checkType,omitempty"` // "checkType": "tcp"
+
+	HeartbeatHeaders map[string]string `json:"healthcheckHeaders,omitempty"` // "healthcheckHeaders": {"Authorization": "Bearer ..."}
+	HeartbeatMethod  string            `json:"healthcheckMethod,omitempty"`  // "healthcheckMethod": "HEAD"
+	HeartbeatBody    string            `json:"healthcheckBody,omitempty"`    // "healthcheckBody": "{\"probe\": true}"
+	HeartbeatTimeout duration          `json:"healthcheckTimeout,omitempty"` // "healthcheckTimeout": "10s"
+	HealthyCodes     []int             `json:"healthyCodes,omitempty"`       // "healthyCodes": [200, 204]
+	// ExpectBody is a regular expression the health-check response body must
+	// match, e.g. "OK".
+	ExpectBody string `json:"expectBody,omitempty"`
+	// InsecureSkipVerify accepts any certificate from an https health check,
+	// for services using self-signed certificates.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+
+	Env        map[string]string `json:"env,omitempty"`        // "env": {"NODE_ENV": "production"}
+	WorkingDir string            `json:"workingDir,omitempty"` // "workingDir": "/srv/node-app"
+	// DependsOn names the applications that must be healthy before this one
+	// is started.
+	DependsOn []serviceName `json:"dependsOn,omitempty"` // "dependsOn": ["DBProxy"]
+	// StartupGrace is how long after being (re)started failed checks are
+	// only logged, so a slow start isn't mistaken for a failure.
+	StartupGrace duration `json:"startupGrace,omitempty"` // "startupGrace": "20s"
+
+	// FailThreshold, RecoverThreshold and Retries override -failThreshold,
+	// -recoverThreshold and -healthRetries for this application when set.
+	FailThreshold    int `json:"failThreshold,omitempty"`    // "failThreshold": 1
+	RecoverThreshold int `json:"recoverThreshold,omitempty"` // "recoverThreshold": 5
+	Retries          int `json:"retries,omitempty"`          // "retries": 1
+
+	Labels map[string]string `json:"labels,omitempty"` // "labels": {"team": "payments"}
+	// Group names the app file group the application takes its defaults
+	// from.
+	Group string `json:"group,omitempty"` // "group": "node-services"
+
+	Status      appStatus `json:"status,omitempty"`
+	LastChecked time.Time `json:"lastChecked"`
+	Restarts    int       `json:"restarts,omitempty"`
+	LastLatency duration  `json:"lastLatency,omitempty"`
+	AvgLatency  duration  `json:"avgLatency,omitempty"`
+
+	// ConsecutiveFailures and ConsecutiveSuccesses are the current streak of
+	// failed or successful checks; one is always zero.
+	ConsecutiveFailures  int `json:"consecutiveFailures"`
+	ConsecutiveSuccesses int `json:"consecutiveSuccesses"`
+
+	// Draining applications stay registered but aren't checked, restarted or
+	// alerted on, e.g. during maintenance.
+	Draining bool `json:"draining,omitempty"`
+
+	// LastTransition is when Status last changed. Uptime and Downtime add up
+	// the time spent in each state up to LastTransition.
+	LastTransition time.Time `json:"lastTransition"`
+	Uptime         duration  `json:"uptime"`
+	Downtime       duration  `json:"downtime"`
+
+	// PID of the process the daemon started for this application, if any,
+	// and when it was started.
+	PID     int       `json:"pid,omitempty"`
+	Started time.Time `json:"started,omitzero"`
+	cmd     *exec.Cmd
+	// exited is closed once cmd has been waited on.
+	exited chan struct{}
+
+	// logger prefixes everything logged about this application with its name.
+	logger *log.Logger
+	// fromFile is set for applications listed in the app file, which a
+	// reload may remove again; ones registered through the API are left
+	// alone, also once restored from -stateFile.
+	fromFile bool
 }
 
-func (r *registry) remove(url string) error {
-	for i := range r.applications {
-		if r.applications[i].ServiceURL == url {
-			r.mutex.Lock()
-			r.applications = append(r.applications[:i], r.applications[i+1:]...)
-			r.mutex.Unlock()
-			return nil
+// checkType selects how an application is health-checked.
+type checkType string
+
+const (
+	// checkHTTP expects a 200 from a GET to the application's healthURL. It is
+	// the default when no check type is given.
+	checkHTTP checkType = "http"
+	// checkTCP only expects a TCP connection to the application's port to
+	// succeed, for services that don't speak HTTP.
+	checkTCP checkType = "tcp"
+	// checkGRPC calls grpc.health.v1.Health/Check on the application's port
+	// and expects SERVING.
+	checkGRPC checkType = "grpc"
+)
+
+// appStatus is the health of an application as last observed by its checks.
+type appStatus string
+
+const (
+	statusUnknown  appStatus = "unknown"
+	statusUp       appStatus = "up"
+	statusDown     appStatus = "down"
+	statusDegraded appStatus = "degraded"
+)
+
+// validate checks that the fields needed to health-check app are present.
+func (a application) validate() error {
+	if a.ServiceName == "" {
+		return fmt.Errorf("application is missing a name")
+	}
+	if _, err := url.Parse(a.ServiceURL); err != nil {
+		return fmt.Errorf("application %v has an invalid url: %w", a.ServiceName, err)
+	}
+	if _, err := url.Parse(a.healthURL()); err != nil {
+		return fmt.Errorf("application %v has an invalid healthcheckURL: %w", a.ServiceName, err)
+	}
+	if _, err := regexp.Compile(a.ExpectBody); err != nil {
+		return fmt.Errorf("application %v has an invalid expectBody: %w", a.ServiceName, err)
+	}
+	if a.Runtime != "" && a.Runtime != runtimeBinary && interpreters[a.Runtime] == "" {
+		return fmt.Errorf("application %v has unknown runtime %q", a.ServiceName, a.Runtime)
+	}
+	switch a.CheckType {
+	case "", checkHTTP:
+		if a.HeartbeatURL == "" {
+			return fmt.Errorf("application %v is missing a healthcheckURL", a.ServiceName)
+		}
+		// An absolute healthcheckURL is the whole target; otherwise it is
+		// joined to url and port, which a port in url makes optional.
+		if u, err := url.Parse(a.HeartbeatURL); err == nil && u.IsAbs() {
+			break
+		}
+		if a.ServiceURL == "" {
+			return fmt.Errorf("application %v is missing a url", a.ServiceName)
 		}
+		if a.Port == 0 && !a.serviceURLHasPort() {
+			return fmt.Errorf("application %v needs a port, in url or on its own", a.ServiceName)
+		}
+	case checkTCP, checkGRPC:
+		if a.ServiceURL == "" {
+			return fmt.Errorf("application %v is missing a url", a.ServiceName)
+		}
+		if a.Port == 0 {
+			return fmt.Errorf("application %v needs a port for %v checks", a.ServiceName, a.CheckType)
+		}
+	default:
+		return fmt.Errorf("application %v has unknown checkType %q", a.ServiceName, a.CheckType)
+	}
+	if a.FailThreshold < 0 || a.RecoverThreshold < 0 || a.Retries < 0 {
+		return fmt.Errorf("application %v has a negative failThreshold, recoverThreshold or retries", a.ServiceName)
 	}
-	return fmt.Errorf("Service at url %v not found", url)
+	return nil
 }
 
-func (r *registry) setupHealthchecks(freq time.Duration) {
-	log.Printf("Setting up healthchecks for %d services\n", len(r.applications))
-	for {
-		var wg sync.WaitGroup
-		for _, app := range r.applications {
-			wg.Add(1)
-			go func(app application) {
-				defer wg.Done()
-				success := true
-				for attempts := 0; attempts < 3; attempts++ {
-					res, err := http.Get(app.HeartbeatURL)
-					if err != nil {
-						log.Println(err)
-					} else if res.StatusCode == http.StatusOK {
-						log.Printf("%v is up.", app.ServiceName)
-						// If previously failed, re-add to applications list
-						if !success {
-							r.add(app)
-						}
-						break
-					}
-					// Handle bad http response
-					log.Printf("%v is down.", app.ServiceName)
-					if success {
-						success = false
-						r.remove(string(app.ServiceURL))
-					}
-					// TODO(moosch): This could be more elegant. Progressive backoff or something to allow more time for reconnection.
-					time.Sleep(1 * time.Second)
-				}
-			}(app)
-			wg.Wait()
-			time.Sleep(freq)
+// hasLabels reports whether a carries every label in selector.
+func (a application) hasLabels(selector map[string]string) bool {
+	for key, value := range selector {
+		if label, ok := a.Labels[key]; !ok || label != value {
+			return false
 		}
 	}
+	return true
 }
 
-func main() {
-	log.SetOutput(os.Stdout)
-	log.Println("Starting Daemon.")
+// arguments are the command-line arguments of an application. In JSON they can
+// be given either as a list or as a single string that is split like a shell
+// would, so "--name 'my app'" becomes ["--name", "my app"].
+type arguments []string
 
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+func (a *arguments) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*a = list
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("args must be a string or a list of strings: %w", err)
+	}
+	split, err := splitArgs(s)
+	if err != nil {
+		return err
+	}
+	*a = split
+	return nil
+}
 
-	signalChan := make(chan os.Signal, 1)
-	// Relay process signals to signalChan
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGHUP)
+// splitArgs splits s into words on unquoted whitespace. Quotes group words
+// together and a backslash outside single quotes escapes the next character.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in args %q", quote, s)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in args %q", s)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
 
-	config := &daemonConfig{}
+// duration is a time.Duration that is read from JSON strings such as "30s".
+type duration time.Duration
 
-	registrations := registry{
-		applications: make([]application, 0),
-		mutex:        new(sync.RWMutex),
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
 	}
+	*d = duration(parsed)
+	return nil
+}
 
-	defer func() {
-		signal.Stop(signalChan)
-		cancel()
-	}()
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
 
-	go func() {
-		for {
-			select {
-			case s := <-signalChan:
-				switch s {
-				case syscall.SIGHUP:
-					config.loadConfig(os.Args)
-				case os.Interrupt:
-					cancel()
-					os.Exit(1)
-				}
-			case <-ctx.Done():
-				log.Println("Daemon shutting down.")
-				os.Exit(1)
-			}
-		}
-	}()
+const defaultServiceURL = "http://localhost"
 
-	if err := config.loadConfig(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "Config error: %s\n", err)
-		os.Exit(1)
+// tcpAddress returns the host:port tcp and grpc checks dial, taking the host
+// from ServiceURL.
+func (a application) tcpAddress() string {
+	host := "localhost"
+	if a.ServiceURL != "" {
+		serviceURL := a.ServiceURL
+		if !strings.Contains(serviceURL, "://") {
+			serviceURL = "tcp://" + serviceURL
+		}
+		if u, err := url.Parse(serviceURL); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
 	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
 
-	if err := registrations.loadApplications(config.appFile); err != nil {
-		fmt.Fprintf(os.Stderr, "Application loading error: %s\n", err)
-		os.Exit(1)
+// serviceURLHasPort reports whether ServiceURL names a port of its own.
+func (a application) serviceURLHasPort() bool {
+	serviceURL := a.ServiceURL
+	if !strings.Contains(serviceURL, "://") {
+		serviceURL = "http://" + serviceURL
 	}
+	u, err := url.Parse(serviceURL)
+	return err == nil && u.Port() != ""
+}
 
-	if err := run(ctx, config); err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(1)
+// healthURL joins ServiceURL, Port and HeartbeatURL into the full health-check
+// target, e.g. http://localhost:8080/healthcheck. An absolute HeartbeatURL is
+// returned as-is, and a port already present in ServiceURL wins over Port.
+func (a application) healthURL() string {
+	ref, err := url.Parse(a.HeartbeatURL)
+	if err == nil && ref.IsAbs() {
+		return a.HeartbeatURL
 	}
 
-	if err := startLogServer(config); err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(1)
+	serviceURL := a.ServiceURL
+	if serviceURL == "" {
+		serviceURL = defaultServiceURL
+	} else if !strings.Contains(serviceURL, "://") {
+		serviceURL = "http://" + serviceURL
 	}
 
-	registrations.setupHealthchecks(config.interval)
-}
-
-func run(ctx context.Context, config *daemonConfig) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-time.Tick(config.interval):
-			// TODO(moosch): Loop through appplications and use go routines to check apps
-			log.Println("Do healthchecks.")
-		}
+	base, baseErr := url.Parse(serviceURL)
+	if err != nil || baseErr != nil {
+		return strings.TrimSuffix(serviceURL, "/") + "/" + strings.TrimPrefix(a.HeartbeatURL, "/")
+	}
+	if base.Port() == "" && a.Port != 0 {
+		base.Host = net.JoinHostPort(base.Hostname(), strconv.Itoa(a.Port))
 	}
+	// The path and query of HeartbeatURL are joined separately, so a query
+	// isn't escaped into the path.
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/" + strings.TrimPrefix(ref.Path, "/")
+	base.RawPath = ""
+	base.RawQuery = ref.RawQuery
+	return base.String()
 }
 
-/** Logging/Telemetry Server */
+type registry struct {
+	applications []application
+	// monitors cancels the health checks of each monitored application.
+	monitors map[serviceName]context.CancelFunc
+	mutex    *sync.RWMutex
+	client   *http.Client
+	// insecureClient skips TLS verification for applications that ask to.
+	insecureClient *http.Client
+	// history holds the most recent check results of each application, up to
+	// historySize of them.
+	history     map[serviceName]*checkHistory
+	historySize int
+	// events receives every status change, if set.
+	events chan stateEvent
+	// subscribers are the /events clients streaming status changes.
+	subscribers *eventSubscribers
+	// checkSlots bounds how many probes run at once; nil means no limit.
+	checkSlots chan struct{}
+	// sequential, with -checkMode=sequential, lets only one application be
+	// health-checked at a time; nil checks them in parallel.
+	sequential chan struct{}
+	// checksAllowed, with -startDelay, is closed once the delay has passed;
+	// every monitor, however it was started, waits for it before its first
+	// check. nil lets checks begin straight away.
+	checksAllowed chan struct{}
+	// config is the current daemon config. A SIGHUP swaps in a freshly loaded
+	// one as a whole, so monitors never see a half-applied reload.
+	config atomic.Pointer[daemonConfig]
+}
 
-func startLogServer(config *daemonConfig) error {
-	log.Println("Starting UDP log service.")
-	port := strconv.Itoa(config.port)
-	conn, err := net.ListenPacket("udp", ":"+port)
+// loadApplications replaces the registry with the applications listed in
+// appFile. With allowEmpty, a missing or empty appFile leaves the registry
+// empty rather than being an error.
+func (r *registry) loadApplications(appFile string, skipInvalid, allowEmpty bool) error {
+	if allowEmpty && appFileMissingOrEmpty(appFile) {
+		logWarn("Warning: no applications in %q, starting with none.", appFile)
+		r.applications = make([]application, 0)
+		return nil
+	}
+	applications, err := readApplicationList(appFile, skipInvalid)
 	if err != nil {
-		log.Fatal("Failed to start log service.")
 		return err
 	}
+	for i := range applications {
+		applications[i].logger = newAppLogger(applications[i].ServiceName)
+		applications[i].fromFile = true
+	}
+	r.applications = applications
+	// Only the names, the definitions may hold secrets.
+	names := make([]string, len(applications))
+	for i, app := range applications {
+		names[i] = string(app.ServiceName)
+	}
+	log.Printf("Applications: %v", strings.Join(names, ", "))
+	return nil
+}
 
-	defer conn.Close()
+// appFileMissingOrEmpty reports whether appFile isn't given, doesn't exist or
+// is a file with nothing but whitespace in it.
+func appFileMissingOrEmpty(appFile string) bool {
+	if appFile == "" {
+		return true
+	}
+	info, err := os.Stat(appFile)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil || info.IsDir() {
+		return false
+	}
+	content, err := ioutil.ReadFile(appFile)
+	return err == nil && len(bytes.TrimSpace(content)) == 0
+}
 
-	for {
-		buf := make([]byte, 1024)
-		// NOTE(moosch): With the addr, we can track the "chatty" applications.
-		_, addr, err := conn.ReadFrom(buf)
-		if err != nil {
-			continue
+// readApplicationList reads the applications listed in appFile. An invalid
+// entry fails the whole read, unless skipInvalid is set, in which case it is
+// logged and left out. Unreadable files in a directory are always logged and
+// skipped.
+func readApplicationList(appFile string, skipInvalid bool) ([]application, error) {
+	list, err := parseApplicationList(appFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range list.unreadable {
+		logWarn("Skipping %v.", err)
+	}
+	for _, err := range list.invalid {
+		if !skipInvalid {
+			return nil, err
 		}
-		go forwardLog(conn, addr, buf, config.forward)
+		logWarn("Skipping invalid application: %v.", err)
 	}
+	if _, err := startOrder(list.applications); err != nil {
+		return nil, err
+	}
+	return list.applications, nil
 }
 
-func forwardLog(conn net.PacketConn, addr net.Addr, buf []byte, forwardURL string) {
-	// 0 - 1: ID
-	// 2: QR(1): Opcode(4)
-	// buf[2] |= 0x80 // Set QR bit
-	log.Printf("Log received: %v", buf)
-
-	time := time.Now().Format(time.ANSIC)
-	responseStr := fmt.Sprintf("time received: %v. Your message: %v!", time, string(buf))
+// applicationList is the outcome of parsing an app file or directory.
+type applicationList struct {
+	// applications are the valid entries.
+	applications []application
+	// invalid describes each entry that failed validation or repeated a name.
+	invalid []error
+	// unreadable describes each file in a directory that couldn't be parsed.
+	unreadable []error
+}
 
-	conn.WriteTo([]byte(responseStr), addr)
+// parseApplicationList parses appFile, or every .json, .yaml and .yml file in
+// it when it is a directory, validating each entry. Only a file (or directory)
+// that can't be read at all is an error.
+func parseApplicationList(appFile string) (applicationList, error) {
+	var list applicationList
+	files := []string{appFile}
+	info, err := os.Stat(appFile)
+	if err != nil {
+		logError("Failed to load app list from %v.", appFile)
+		return list, err
+	}
+	if info.IsDir() {
+		if files, err = appFiles(appFile); err != nil {
+			logError("Failed to load app list from %v.", appFile)
+			return list, err
+		}
+	}
 
-	// TODO(moosch): Forward on to URL
-	// if forwardURL != "" {
+	seen := make(map[serviceName]bool)
+	for _, file := range files {
+		applications, err := readApplications(file)
+		if err != nil {
+			if !info.IsDir() {
+				return list, err
+			}
+			list.unreadable = append(list.unreadable, fmt.Errorf("%v: %w", file, err))
+			continue
+		}
+
+		for i, app := range applications {
+			err := app.validate()
+			if err == nil && seen[app.ServiceName] {
+				err = fmt.Errorf("application %v is listed more than once", app.ServiceName)
+			}
+			if err != nil {
+				list.invalid = append(list.invalid, fmt.Errorf("%v entry %d: %w", file, i+1, err))
+				continue
+			}
+			app.Status = statusUnknown
+			seen[app.ServiceName] = true
+			list.applications = append(list.applications, app)
+		}
+	}
+	return list, nil
+}
+
+// appFiles lists the application files in dir, in name order.
+func appFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json", ".yaml", ".yml":
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// readApplications parses the applications listed in a single JSON or YAML
+// file.
+func readApplications(file string) ([]application, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		logError("Failed to load app list from %v.", file)
+		return nil, err
+	}
+
+	// YAML is converted to JSON first so both formats share the json struct
+	// tags and the custom arguments and duration decoding.
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		content, err = yamlToJSON(content)
+		if err != nil {
+			logError("Invalid app list from %v.", file)
+			return nil, err
+		}
+	}
+
+	// A file is either a list of applications or an object holding groups
+	// as well as the applications.
+	var list appFileContent
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(content, &list)
+	} else {
+		err = json.Unmarshal(content, &list.Applications)
+	}
+	if err != nil {
+		logError("Invalid app list from %v.", file)
+		return nil, err
+	}
+
+	applications := make([]application, 0, len(list.Applications))
+	for i, raw := range list.Applications {
+		raw, err := withGroupDefaults(raw, list.Groups)
+		if err != nil {
+			logError("Invalid app list from %v.", file)
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		var app application
+		if err := json.Unmarshal(raw, &app); err != nil {
+			logError("Invalid app list from %v.", file)
+			return nil, err
+		}
+		applications = append(applications, app)
+	}
+	return applications, nil
+}
+
+// appFileContent is an app file that defines groups: shared defaults that
+// applications inherit by naming the group.
+type appFileContent struct {
+	Groups       map[string]json.RawMessage `json:"groups"`
+	Applications []json.RawMessage          `json:"applications"`
+}
+
+// withGroupDefaults fills in the fields raw doesn't set from the group it
+// names, if any. Fields the application sets itself override the group's.
+func withGroupDefaults(raw json.RawMessage, groups map[string]json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	group, ok := fields["group"]
+	if !ok {
+		return raw, nil
+	}
+	var name string
+	if err := json.Unmarshal(group, &name); err != nil {
+		return nil, fmt.Errorf("group must be a string: %w", err)
+	}
+	defaults, ok := groups[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown group %q", name)
+	}
+
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(defaults, &merged); err != nil {
+		return nil, fmt.Errorf("group %v: %w", name, err)
+	}
+	for field, value := range fields {
+		merged[field] = value
+	}
+	return json.Marshal(merged)
+}
+
+// yamlToJSON re-encodes a YAML document as JSON.
+func yamlToJSON(content []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// add registers reg, refusing an application that fails validation, or a second
+// application with the same name so it isn't probed twice.
+func (r *registry) add(reg application) error {
+	if err := reg.validate(); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, app := range r.applications {
+		if app.ServiceName == reg.ServiceName {
+			return fmt.Errorf("Service %v is already registered", reg.ServiceName)
+		}
+	}
+	reg.logger = newAppLogger(reg.ServiceName)
+	r.applications = append(r.applications, reg)
+	return nil
+}
+
+// removeByName removes the application named name from the registry, along
+// with its check history, and stops its health checks.
+func (r *registry) removeByName(name serviceName) error {
+	r.mutex.Lock()
+	for i := range r.applications {
+		if r.applications[i].ServiceName == name {
+			r.applications = append(r.applications[:i], r.applications[i+1:]...)
+			delete(r.history, name)
+			r.mutex.Unlock()
+			r.stopMonitor(name)
+			return nil
+		}
+	}
+	r.mutex.Unlock()
+	return fmt.Errorf("Service %v not found", name)
+}
+
+// checkInterval returns the application's own interval, falling back to the
+// daemon-wide default when it has none.
+func (a application) checkInterval(fallback time.Duration) time.Duration {
+	if a.Interval > 0 {
+		return time.Duration(a.Interval)
+	}
+	return fallback
+}
+
+// checkConfig returns config with the application's own thresholds and
+// retries, where it has any, in place of the daemon-wide ones.
+func (a application) checkConfig(config *daemonConfig) *daemonConfig {
+	if a.FailThreshold == 0 && a.RecoverThreshold == 0 && a.Retries == 0 {
+		return config
+	}
+	overridden := *config
+	if a.FailThreshold > 0 {
+		overridden.failThreshold = a.FailThreshold
+	}
+	if a.RecoverThreshold > 0 {
+		overridden.recoverThreshold = a.RecoverThreshold
+	}
+	if a.Retries > 0 {
+		overridden.healthRetries = a.Retries
+	}
+	return &overridden
+}
+
+// checkTimeout returns the application's own health-check timeout, falling
+// back to the daemon-wide -healthTimeout when it has none.
+func (a application) checkTimeout(fallback time.Duration) time.Duration {
+	if a.HeartbeatTimeout > 0 {
+		return time.Duration(a.HeartbeatTimeout)
+	}
+	return fallback
+}
+
+// update applies fn to the application registered under name in place and
+// reports whether it was found.
+func (r *registry) update(name serviceName, fn func(app *application)) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range r.applications {
+		if r.applications[i].ServiceName == name {
+			fn(&r.applications[i])
+			return true
+		}
+	}
+	return false
+}
+
+// setDraining drains or undrains name, reporting whether it is registered.
+func (r *registry) setDraining(name serviceName, draining bool) bool {
+	return r.update(name, func(app *application) {
+		app.Draining = draining
+	})
+}
+
+// setStatus records the outcome of checked's latest health check, its status
+// and streaks, in place, so applications stay registered whether they are up
+// or down.
+func (r *registry) setStatus(checked application) {
+	var event *stateEvent
+	r.update(checked.ServiceName, func(app *application) {
+		if app.Status != checked.Status {
+			*app = app.withCurrentTotals(checked.LastChecked)
+			app.LastTransition = checked.LastChecked
+			event = &stateEvent{Service: app.ServiceName, Old: app.Status, New: checked.Status, Time: checked.LastChecked}
+		}
+		app.Status = checked.Status
+		app.LastChecked = checked.LastChecked
+		app.ConsecutiveFailures = checked.ConsecutiveFailures
+		app.ConsecutiveSuccesses = checked.ConsecutiveSuccesses
+	})
+	if event != nil {
+		r.publish(*event)
+	}
+}
+
+// withCurrentTotals returns a copy of a whose Uptime and Downtime include the
+// time spent in its current state up to now. Nothing is counted while the
+// status is still unknown, so the uptime clock starts at the first check.
+func (a application) withCurrentTotals(now time.Time) application {
+	if a.LastTransition.IsZero() || now.Before(a.LastTransition) {
+		return a
+	}
+	elapsed := duration(now.Sub(a.LastTransition))
+	switch a.Status {
+	case statusUp, statusDegraded:
+		// A degraded service is still answering some of the time.
+		a.Uptime += elapsed
+	case statusDown:
+		a.Downtime += elapsed
+	}
+	return a
+}
+
+// registryState is the on-disk form of the registry.
+type registryState struct {
+	Applications []savedApplication `json:"applications"`
+}
+
+// savedApplication is an application in the state file, along with whether it
+// came from the app file.
+type savedApplication struct {
+	application
+	FromFile bool `json:"fromFile,omitempty"`
+}
+
+// save writes the registry, including each application's status, to path as
+// JSON. The file is replaced atomically so a crash mid-write can't leave a
+// truncated state behind, and is only readable by the daemon's user since
+// definitions may hold secrets such as health-check headers or env.
+func (r *registry) save(path string) error {
+	var state registryState
+	for _, app := range r.snapshot() {
+		state.Applications = append(state.Applications, savedApplication{application: app, FromFile: app.fromFile})
+	}
+
+	content, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	// WriteFile keeps the mode of a file left behind by an earlier run.
+	os.Remove(tmp)
+	if err := ioutil.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load merges the state persisted at path into the registry. Definitions from
+// the app file take precedence but pick up their last known status. Services
+// registered at runtime are added alongside them, while ones that came from the
+// app file and are no longer in it stay removed.
+func (r *registry) load(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var state registryState
+	if err := json.Unmarshal(content, &state); err != nil {
+		logError("Invalid registry state in %v.", path)
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	known := make(map[serviceName]int, len(r.applications))
+	for i, app := range r.applications {
+		known[app.ServiceName] = i
+	}
+	for _, saved := range state.Applications {
+		app := saved.application
+		if i, ok := known[app.ServiceName]; ok {
+			r.applications[i].Status = app.Status
+			r.applications[i].LastChecked = app.LastChecked
+			r.applications[i].LastTransition = app.LastTransition
+			r.applications[i].Uptime = app.Uptime
+			r.applications[i].Downtime = app.Downtime
+			r.applications[i].Draining = app.Draining
+			continue
+		}
+		if saved.FromFile {
+			continue
+		}
+		if err := app.validate(); err != nil {
+			logWarn("Skipping %v from %v: %v.", app.ServiceName, path, err)
+			continue
+		}
+		// Processes from the previous run aren't ours to track any more.
+		app.PID = 0
+		app.Started = time.Time{}
+		app.logger = newAppLogger(app.ServiceName)
+		known[app.ServiceName] = len(r.applications)
+		r.applications = append(r.applications, app)
+	}
+	return nil
+}
+
+// persist saves the registry to path every interval until ctx is cancelled.
+func (r *registry) persist(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.save(path); err != nil {
+				logError("Failed to save registry state to %v: %v", path, err)
+			}
+		}
+	}
+}
+
+// findByURL returns the names of the applications whose ServiceURL or full
+// health-check URL is url. Applications often share a ServiceURL, e.g.
+// http://localhost, so there may be several.
+func (r *registry) findByURL(url string) []serviceName {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var names []serviceName
+	for _, app := range r.applications {
+		if app.ServiceURL == url || app.healthURL() == url {
+			names = append(names, app.ServiceName)
+		}
+	}
+	return names
+}
+
+// get returns the application registered under name, if any.
+func (r *registry) get(name serviceName) (application, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, app := range r.applications {
+		if app.ServiceName == name {
+			return app, true
+		}
+	}
+	return application{}, false
+}
+
+// snapshot returns a copy of the registered applications that callers can
+// range over without holding the registry lock.
+func (r *registry) snapshot() []application {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	applications := make([]application, len(r.applications))
+	copy(applications, r.applications)
+	return applications
+}
+
+// checkOnce health-checks every application a single time, concurrently and
+// with the usual retries, prints a summary and returns the exit code: 0 if
+// all of them are healthy, 1 otherwise.
+func (r *registry) checkOnce(config *daemonConfig) int {
+	applications := r.snapshot()
+	healthy := make([]bool, len(applications))
+	var wg sync.WaitGroup
+	for i, app := range applications {
+		wg.Add(1)
+		go func(i int, app application) {
+			defer wg.Done()
+			healthy[i] = r.healthcheck(app, app.checkConfig(config))
+		}(i, app)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, app := range applications {
+		status := statusUp
+		if !healthy[i] {
+			status = statusDown
+			failed++
+		}
+		fmt.Printf("%-20v %v\n", app.ServiceName, status)
+	}
+	fmt.Printf("%d of %d applications healthy.\n", len(applications)-failed, len(applications))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// setupHealthchecks starts monitoring every registered application, lets
+// health checks begin once delay has passed and then waits until ctx is done,
+// when it stops every monitor, including those started since, and returns once
+// the ones it started have finished.
+func (r *registry) setupHealthchecks(ctx context.Context, delay time.Duration) {
+	// Work from a copy so add/remove from the probes can't race the loop.
+	applications := r.snapshot()
+
+	log.Printf("Setting up healthchecks for %d services\n", len(applications))
+	// Every application gets its own goroutine up front, so all services are
+	// probed concurrently rather than one by one.
+	var wg sync.WaitGroup
+	for _, app := range applications {
+		wg.Add(1)
+		monitorCtx := r.monitorContext(app.ServiceName)
+		go func(app application) {
+			defer wg.Done()
+			r.monitor(monitorCtx, app)
+		}(app)
+	}
+
+	if delay > 0 {
+		log.Printf("Waiting %v before the first health checks.", delay)
+	}
+	checksBegin(delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		if r.checksAllowed != nil {
+			close(r.checksAllowed)
+		}
+		<-ctx.Done()
+	}
+	r.stopMonitors()
+	wg.Wait()
+	log.Println("Health checks stopped.")
+}
+
+// monitorContext returns a context for name's health checks that is cancelled
+// by stopMonitor.
+func (r *registry) monitorContext(name serviceName) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if previous, ok := r.monitors[name]; ok {
+		previous()
+	}
+	r.monitors[name] = cancel
+	return ctx
+}
+
+// stopMonitors stops health-checking every application.
+func (r *registry) stopMonitors() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, cancel := range r.monitors {
+		cancel()
+		delete(r.monitors, name)
+	}
+}
+
+// stopMonitor stops the health checks of name, if it is being monitored.
+func (r *registry) stopMonitor(name serviceName) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if cancel, ok := r.monitors[name]; ok {
+		cancel()
+		delete(r.monitors, name)
+	}
+}
+
+// monitor health-checks app on its own ticker until ctx is cancelled, updating
+// its status in the registry after every check. Each check uses the config
+// current at the time, so a SIGHUP reload applies from the next check on.
+func (r *registry) monitor(ctx context.Context, app application) {
+	if r.checksAllowed != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.checksAllowed:
+		}
+	}
+
+	// Start each application at a random point early in its interval so they
+	// aren't all probed in lockstep.
+	config := r.config.Load()
+	interval := app.checkInterval(config.interval)
+	timer := time.NewTimer(time.Duration(rand.Float64() * config.healthJitter * float64(interval)))
+	defer timer.Stop()
+
+	// Restarts back off exponentially so a crash-looping service isn't hammered.
+	restarts := 0
+	gaveUp := false
+	var nextRestart time.Time
+
+	var alerts alertState
+
+	check := func() {
+		config := app.checkConfig(r.config.Load())
+		if current, ok := r.get(app.ServiceName); ok && current.Draining {
+			return
+		}
+		healthy := r.healthcheck(app, config)
+		if ctx.Err() != nil {
+			// Deregistered while the probe was in flight.
+			return
+		}
+		if !healthy && app.StartupGrace > 0 {
+			if current, ok := r.get(app.ServiceName); ok && time.Since(current.Started) < time.Duration(app.StartupGrace) {
+				app.logger.Println("Failed a check during its start-up grace, not counting it.")
+				return
+			}
+		}
+		if healthy {
+			app.ConsecutiveFailures, app.ConsecutiveSuccesses = 0, app.ConsecutiveSuccesses+1
+		} else {
+			app.ConsecutiveFailures, app.ConsecutiveSuccesses = app.ConsecutiveFailures+1, 0
+		}
+		app.LastChecked = time.Now()
+		app.Status = nextStatus(app.Status, app.ConsecutiveFailures, app.ConsecutiveSuccesses, config)
+		r.setStatus(app)
+		alerts.update(app.ServiceName, app.Status, app.LastChecked, config)
+
+		if app.Status == statusUp {
+			restarts, gaveUp = 0, false
+			return
+		}
+		if app.Status != statusDown || !(config.restart || config.restartDryRun) || app.LastChecked.Before(nextRestart) {
+			return
+		}
+		if config.maxRestarts > 0 && restarts >= config.maxRestarts {
+			if !gaveUp {
+				logAt(app.logger, levelError, "Still down after %d restarts, giving up.", restarts)
+				gaveUp = true
+			}
+			return
+		}
+		restarts++
+		nextRestart = app.LastChecked.Add(exponentialBackoff(config.restartBackoff, restarts-1, maxRestartBackoff))
+		if config.restartDryRun {
+			r.logRestart(app, restarts)
+			return
+		}
+		r.restartApplication(app, restarts)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			check()
+			config := r.config.Load()
+			timer.Reset(jittered(app.checkInterval(config.interval), config.healthJitter))
+		}
+	}
+}
+
+// jittered spreads interval randomly by up to ±fraction of itself.
+func jittered(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return interval
+	}
+	spread := (rand.Float64()*2 - 1) * fraction * float64(interval)
+	return interval + time.Duration(spread)
+}
+
+// nextStatus works out an application's status from its current one and its
+// streak of consecutive failed or successful checks. A single failure only
+// degrades a service; it is down after config.failThreshold failures in a row
+// and only recovers after config.recoverThreshold successes in a row, so one
+// transient error doesn't make it flap.
+func nextStatus(current appStatus, failures, successes int, config *daemonConfig) appStatus {
+	failThreshold, recoverThreshold := config.failThreshold, config.recoverThreshold
+	if failThreshold < 1 {
+		failThreshold = 1
+	}
+	if recoverThreshold < 1 {
+		recoverThreshold = 1
+	}
+
+	switch {
+	case failures >= failThreshold:
+		return statusDown
+	case failures > 0:
+		if current == statusDown {
+			return statusDown
+		}
+		return statusDegraded
+	case current == statusUnknown || current == statusUp || successes >= recoverThreshold:
+		return statusUp
+	default:
+		return current
+	}
+}
+
+// healthcheck probes app up to config.healthRetries times, backing off between
+// attempts as -healthBackoffStrategy says, and reports whether it is healthy. A
+// service is only considered down once every attempt has failed.
+func (r *registry) healthcheck(app application, config *daemonConfig) bool {
+	defer checkCompleted()
+	if r.sequential != nil {
+		r.sequential <- struct{}{}
+		defer func() {
+			time.Sleep(sequentialCheckGap)
+			<-r.sequential
+		}()
+	}
+	counters.healthChecks.Add(1)
+	attempts := config.healthRetries
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := backoffStrategies[config.healthBackoffStrategy](config.healthBackoff, maxHealthBackoff)
+	for attempt := 0; attempt < attempts; attempt++ {
+		if r.probe(app) {
+			app.logger.Println("Up.")
+			return true
+		}
+		if attempt < attempts-1 {
+			time.Sleep(backoff.nextDelay(attempt))
+		}
+	}
+	logAt(app.logger, levelWarn, "Down.")
+	counters.healthFailures.Add(1)
+	return false
+}
+
+// probe makes a single health check of app and records how long it took to
+// answer.
+func (r *registry) probe(app application) bool {
+	if r.checkSlots != nil {
+		r.checkSlots <- struct{}{}
+		defer func() { <-r.checkSlots }()
+	}
+
+	timeout := app.checkTimeout(r.config.Load().healthTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	var (
+		statusCode int
+		err        error
+	)
+	switch app.CheckType {
+	case checkTCP:
+		err = r.probeTCP(ctx, app)
+	case checkGRPC:
+		err = r.probeGRPC(ctx, app)
+	default:
+		statusCode, err = r.probeHTTP(ctx, app)
+	}
+	latency := time.Since(start)
+	if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+		latency = timeout
+	}
+	r.recordLatency(app.ServiceName, latency)
+	r.recordResult(app.ServiceName, checkResult{
+		Time:       start,
+		OK:         err == nil,
+		Latency:    duration(latency),
+		StatusCode: statusCode,
+	})
+
+	if err != nil {
+		logAt(app.logger, levelWarn, "%v", err)
+		return false
+	}
+	return true
+}
+
+// probeHTTP makes an HTTP health check and returns the response status code.
+func (r *registry) probeHTTP(ctx context.Context, app application) (int, error) {
+	method := app.HeartbeatMethod
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if app.HeartbeatBody != "" {
+		body = strings.NewReader(app.HeartbeatBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, app.healthURL(), body)
+	if err != nil {
+		return 0, err
+	}
+	// Set first so an application's own headers can override it.
+	req.Header.Set("User-Agent", r.config.Load().userAgent)
+	for name, value := range app.HeartbeatHeaders {
+		req.Header.Set(name, value)
+	}
+
+	client := r.client
+	if app.InsecureSkipVerify {
+		client = r.insecureClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// Always drain and close the body so the connection can be reused.
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxHealthBodySize))
+		res.Body.Close()
+	}()
+
+	if !app.isHealthyCode(res.StatusCode) {
+		return res.StatusCode, fmt.Errorf("%v health check responded %v", app.ServiceName, res.Status)
+	}
+	if app.ExpectBody != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxHealthBodySize))
+		if err != nil {
+			return res.StatusCode, err
+		}
+		matched, err := regexp.Match(app.ExpectBody, body)
+		if err != nil {
+			return res.StatusCode, err
+		}
+		if !matched {
+			return res.StatusCode, fmt.Errorf("%v health check body doesn't match %q", app.ServiceName, app.ExpectBody)
+		}
+	}
+	return res.StatusCode, nil
+}
+
+// isHealthyCode reports whether an HTTP health check answering code passes.
+// Only 200 does unless the application lists its own HealthyCodes.
+func (a application) isHealthyCode(code int) bool {
+	if len(a.HealthyCodes) == 0 {
+		return code == http.StatusOK
+	}
+	for _, healthy := range a.HealthyCodes {
+		if code == healthy {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *registry) probeTCP(ctx context.Context, app application) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", app.tcpAddress())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeGRPC uses the standard gRPC Health Checking protocol to ask the server
+// about its overall health.
+func (r *registry) probeGRPC(ctx context.Context, app application) error {
+	conn, err := grpc.NewClient(app.tcpAddress(), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithUserAgent(r.config.Load().userAgent))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%v health check responded %v", app.ServiceName, res.GetStatus())
+	}
+	return nil
+}
+
+// latencyWeight is how much each new measurement moves the average latency.
+const latencyWeight = 0.2
+
+// recordLatency stores latency as name's last health-check latency and folds
+// it into the exponentially weighted rolling average.
+func (r *registry) recordLatency(name serviceName, latency time.Duration) {
+	r.update(name, func(app *application) {
+		app.LastLatency = duration(latency)
+		if app.AvgLatency == 0 {
+			app.AvgLatency = duration(latency)
+			return
+		}
+		avg := float64(app.AvgLatency)*(1-latencyWeight) + float64(latency)*latencyWeight
+		app.AvgLatency = duration(avg)
+	})
+}
+
+// newHealthTransport returns the pooled transport health checks share.
+func newHealthTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = false
+	transport.MaxIdleConns = healthMaxIdleConns
+	transport.MaxIdleConnsPerHost = healthMaxIdleConnsPerHost
+	transport.IdleConnTimeout = healthIdleConnTimeout
+	return transport
+}
+
+// exponentialBackoff returns base * 2^attempt, capped at max.
+func exponentialBackoff(base time.Duration, attempt int, max time.Duration) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[1:]))
+	}
+
+	log.SetOutput(os.Stdout)
+	log.Println("Starting Daemon.")
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	// The log services have a context of their own, so on SIGUSR2 they keep
+	// reading logs until just before the new daemon takes them over.
+	logCtx, stopLogs := context.WithCancel(context.Background())
+
+	signalChan := make(chan os.Signal, 1)
+	// Relay process signals to signalChan
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+
+	config := &daemonConfig{}
+
+	registrations := registry{
+		applications: make([]application, 0),
+		monitors:     make(map[serviceName]context.CancelFunc),
+		history:      make(map[serviceName]*checkHistory),
+		mutex:        new(sync.RWMutex),
+	}
+	registrations.config.Store(config)
+
+	saveState := func() {
+		stateFile := registrations.config.Load().stateFile
+		if stateFile == "" {
+			return
+		}
+		if err := registrations.save(stateFile); err != nil {
+			logError("Failed to save registry state to %v: %v", stateFile, err)
+		}
+	}
+
+	// apiStopped is closed once the HTTP API has drained, logsFlushed once
+	// the last batch of logs has been forwarded and unixStopped once the Unix
+	// socket file is removed, so shutdown can wait for in-flight work before
+	// exiting.
+	apiStopped := make(chan struct{})
+	logsFlushed := make(chan struct{})
+	unixStopped := make(chan struct{})
+	waitStopped := func(channels ...chan struct{}) {
+		timeout := time.After(apiDrainTimeout + forwardTimeout)
+		for _, stopped := range channels {
+			select {
+			case <-stopped:
+			case <-timeout:
+				return
+			}
+		}
+	}
+
+	defer func() {
+		signal.Stop(signalChan)
+		cancel()
+		stopLogs()
+	}()
+
+	go func() {
+		for {
+			select {
+			case s := <-signalChan:
+				switch s {
+				case syscall.SIGHUP:
+					// Load into a fresh config and swap it in whole, so
+					// nothing ever reads a half-reloaded one.
+					reloaded := &daemonConfig{}
+					if err := reloaded.loadConfig(os.Args); err != nil {
+						logError("Failed to reload config, keeping the current one: %v", err)
+						continue
+					}
+					reloaded.print()
+					registrations.config.Store(reloaded)
+					registrations.reload(reloaded)
+				case os.Interrupt, syscall.SIGTERM:
+					cancel()
+					stopLogs()
+					registrations.stopApplications(registrations.config.Load().shutdownGrace)
+					waitStopped(apiStopped, logsFlushed, unixStopped)
+					saveState()
+					// A signal-initiated shutdown is a clean exit, not a crash.
+					os.Exit(0)
+				case syscall.SIGUSR2:
+					// Hold on to the log socket so it stays open, and logs
+					// queue up in it, while this daemon hands over to the
+					// next one.
+					socket, err := logSocketFile()
+					if err != nil {
+						logWarn("Can't hand over the log socket, the new daemon will open its own: %v", err)
+					}
+					log.Println("Re-executing the daemon.")
+					cancel()
+					// Started applications write their output to pipes this
+					// daemon reads, which close when it exits, so they are
+					// stopped and left for the new daemon to start again.
+					// Logs are still read meanwhile.
+					registrations.stopApplications(registrations.config.Load().shutdownGrace)
+					waitStopped(apiStopped)
+					saveState()
+					// From here until the new daemon's log services start,
+					// UDP logs wait in the socket's receive buffer.
+					stopLogs()
+					waitStopped(unixStopped)
+					if err := reexec(socket); err != nil {
+						logError("Failed to re-execute the daemon: %v", err)
+						os.Exit(1)
+					}
+					// Logs already received are forwarded alongside the new
+					// daemon.
+					waitStopped(logsFlushed)
+					os.Exit(0)
+				}
+			case <-ctx.Done():
+				log.Println("Daemon shutting down.")
+				stopLogs()
+				waitStopped(apiStopped, logsFlushed, unixStopped)
+				saveState()
+				os.Exit(0)
+			}
+		}
+	}()
+
+	if err := config.loadConfig(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %s\n", err)
+		os.Exit(1)
+	}
+	if config.logFormat == logFormatJSON {
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{out: os.Stdout})
+	}
+	config.print()
+
+	if err := registrations.loadApplications(config.appFile, config.skipInvalid, config.allowEmptyRegistry); err != nil {
+		fmt.Fprintf(os.Stderr, "Application loading error: %s\n", err)
+		os.Exit(1)
+	}
+
+	registrations.historySize = config.historySize
+	registrations.subscribers = newEventSubscribers(config.maxEventSubscribers)
+	if config.maxConcurrentChecks > 0 {
+		registrations.checkSlots = make(chan struct{}, config.maxConcurrentChecks)
+	}
+	if config.checkMode == checkSequential {
+		registrations.sequential = make(chan struct{}, 1)
+	}
+	if config.startDelay > 0 {
+		registrations.checksAllowed = make(chan struct{})
+	}
+
+	// A dedicated client whose probes are each bounded by a timeout, so a hung
+	// service can't hold one open forever. Every probe shares its transport,
+	// so connections to a service are kept alive and reused from one check to
+	// the next.
+	transport := newHealthTransport()
+	registrations.client = &http.Client{Transport: transport}
+	insecureTransport := transport.Clone()
+	insecureTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	registrations.insecureClient = &http.Client{Transport: insecureTransport}
+
+	if config.once {
+		os.Exit(registrations.checkOnce(config))
+	}
+
+	if config.stateFile != "" {
+		if err := registrations.load(config.stateFile); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Registry state error: %s\n", err)
+			os.Exit(1)
+		}
+		go registrations.persist(ctx, config.stateFile, config.saveInterval)
+	}
+
+	logStats := newSourceStats(config)
+	logs := &logSinks{stats: logStats, overflow: config.forwardOverflow}
+	if config.maxForwardInflight > 0 {
+		logs.inflight = make(chan struct{}, config.maxForwardInflight)
+	}
+	if config.logFile != "" {
+		file, err := openRotatingFile(config.logFile, config.logFileMaxSize, config.logFileBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Log file error: %s\n", err)
+			os.Exit(1)
+		}
+		logs.file = file
+	}
+	// Each destination gets a queue of its own, so one that is slow or down
+	// doesn't hold up delivery to the others.
+	for _, forward := range config.forward {
+		logs.queues = append(logs.queues, newForwardQueue(forward, config.forwardQueueSize, config.forwardRetries, config.forwardGzip))
+	}
+	if len(logs.queues) > 0 && config.forwardBatchSize > 1 {
+		logs.batch = newLogBatcher(logs.queues, config.forwardBatchSize, config.forwardFlushInterval)
+	}
+	go func() {
+		if logs.batch != nil {
+			logs.batch.run(logCtx)
+		} else {
+			<-logCtx.Done()
+		}
+		for _, queue := range logs.queues {
+			queue.close()
+		}
+	}()
+	var flushing sync.WaitGroup
+	for _, queue := range logs.queues {
+		flushing.Add(1)
+		go func(queue *forwardQueue) {
+			defer flushing.Done()
+			queue.run(logCtx)
+		}(queue)
+	}
+	go func() {
+		flushing.Wait()
+		close(logsFlushed)
+	}()
+
+	if eventURL := config.eventDestination(); eventURL != "" {
+		registrations.events = make(chan stateEvent, eventBufferSize)
+		go forwardEvents(ctx, registrations.events, eventURL)
+	}
+
+	go func() {
+		defer close(apiStopped)
+		if err := startAPIServer(ctx, config, &registrations, logStats); err != nil {
+			fmt.Fprintf(os.Stderr, "API server error: %s\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	// The log servers block, so each gets its own goroutine; the health-check
+	// scheduler runs on this one. They start before the applications, which
+	// may log straight away, and after a SIGUSR2 take over the previous
+	// daemon's socket as soon as possible.
+	if config.logServer {
+		go func() {
+			if err := startLogServer(logCtx, config, logs); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if config.tcpPort != 0 {
+		go func() {
+			if err := startTCPLogServer(logCtx, config, logs); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if config.unixSocket != "" {
+		go func() {
+			defer close(unixStopped)
+			if err := startUnixLogServer(logCtx, config, logs); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+		}()
+	} else {
+		close(unixStopped)
+	}
+
+	if config.selfHeartbeat > 0 {
+		go sendSelfHeartbeats(ctx, config.selfHeartbeatURL, config.selfHeartbeat)
+	}
+
+	if !config.noStart {
+		if err := registrations.startApplications(config.startupTimeout); err != nil {
+			logWarn("Start-up incomplete: %v.", err)
+		}
+	}
+
+	if config.watch && config.appFile != "" {
+		go func() {
+			if err := registrations.watchApplications(ctx, config); err != nil {
+				logError("Failed to watch %v: %v", config.appFile, err)
+			}
+		}()
+	}
 
-	// }
+	registrations.setupHealthchecks(ctx, config.startDelay)
+	// The signal handler exits once applications are stopped and the API has
+	// drained; returning here would cut that short.
+	select {}
 }
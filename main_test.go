@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRegistry returns a registry holding applications, set up the way main
+// sets one up from the command line args.
+func newTestRegistry(t *testing.T, args []string, applications ...application) *registry {
+	t.Helper()
+	config := &daemonConfig{}
+	if err := config.loadConfig(append([]string{"daemon", "-allowEmptyRegistry"}, args...)); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	for i := range applications {
+		applications[i].Status = statusUnknown
+		applications[i].logger = newAppLogger(applications[i].ServiceName)
+	}
+	r := &registry{
+		applications: applications,
+		monitors:     make(map[serviceName]context.CancelFunc),
+		history:      make(map[serviceName]*checkHistory),
+		mutex:        new(sync.RWMutex),
+		historySize:  config.historySize,
+		client:       &http.Client{Transport: newHealthTransport()},
+	}
+	r.insecureClient = r.client
+	r.config.Store(config)
+	return r
+}
+
+func TestHealthURL(t *testing.T) {
+	tests := []struct {
+		name string
+		app  application
+		want string
+	}{
+		{
+			name: "service URL, port and path",
+			app:  application{ServiceURL: "http://localhost", Port: 8080, HeartbeatURL: "/healthcheck"},
+			want: "http://localhost:8080/healthcheck",
+		},
+		{
+			name: "path without leading slash",
+			app:  application{ServiceURL: "http://localhost", Port: 8080, HeartbeatURL: "healthcheck"},
+			want: "http://localhost:8080/healthcheck",
+		},
+		{
+			name: "service URL with trailing slash",
+			app:  application{ServiceURL: "http://localhost/", Port: 8080, HeartbeatURL: "/healthcheck"},
+			want: "http://localhost:8080/healthcheck",
+		},
+		{
+			name: "service URL with a path",
+			app:  application{ServiceURL: "http://localhost/api", Port: 8080, HeartbeatURL: "/health"},
+			want: "http://localhost:8080/api/health",
+		},
+		{
+			name: "query string",
+			app:  application{ServiceURL: "http://localhost", Port: 8080, HeartbeatURL: "/health?verbose=1"},
+			want: "http://localhost:8080/health?verbose=1",
+		},
+		{
+			name: "port in service URL wins",
+			app:  application{ServiceURL: "http://localhost:9000", Port: 8080, HeartbeatURL: "/health"},
+			want: "http://localhost:9000/health",
+		},
+		{
+			name: "no scheme",
+			app:  application{ServiceURL: "127.0.0.1", Port: 8080, HeartbeatURL: "/health"},
+			want: "http://127.0.0.1:8080/health",
+		},
+		{
+			name: "https",
+			app:  application{ServiceURL: "https://example.com", Port: 8443, HeartbeatURL: "/health"},
+			want: "https://example.com:8443/health",
+		},
+		{
+			name: "absolute healthcheck URL",
+			app:  application{ServiceURL: "http://localhost", Port: 8080, HeartbeatURL: "http://other:9090/ping?x=1"},
+			want: "http://other:9090/ping?x=1",
+		},
+		{
+			name: "no healthcheck path",
+			app:  application{ServiceURL: "http://localhost", Port: 8080},
+			want: "http://localhost:8080/",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.app.healthURL(); got != test.want {
+				t.Errorf("healthURL() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateApplication(t *testing.T) {
+	tests := []struct {
+		name string
+		app  application
+		ok   bool
+	}{
+		{"http", application{ServiceName: "a", ServiceURL: "http://localhost", Port: 8080, HeartbeatURL: "/health"}, true},
+		{"port in url", application{ServiceName: "a", ServiceURL: "http://localhost:8080", HeartbeatURL: "/health"}, true},
+		{"absolute healthcheckURL", application{ServiceName: "a", HeartbeatURL: "http://localhost:8080/health"}, true},
+		{"tcp", application{ServiceName: "a", ServiceURL: "localhost", Port: 8080, CheckType: checkTCP}, true},
+		{"no name", application{ServiceURL: "http://localhost", Port: 8080, HeartbeatURL: "/health"}, false},
+		{"no url", application{ServiceName: "a", Port: 8080, HeartbeatURL: "/health"}, false},
+		{"no port", application{ServiceName: "a", ServiceURL: "http://localhost", HeartbeatURL: "/health"}, false},
+		{"no healthcheckURL", application{ServiceName: "a", ServiceURL: "http://localhost", Port: 8080}, false},
+		{"tcp without url", application{ServiceName: "a", Port: 8080, CheckType: checkTCP}, false},
+		{"tcp without port", application{ServiceName: "a", ServiceURL: "localhost", CheckType: checkTCP}, false},
+	}
+	for _, test := range tests {
+		if err := test.app.validate(); (err == nil) != test.ok {
+			t.Errorf("%v: validate() = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "", want: nil},
+		{in: "--port 8080", want: []string{"--port", "8080"}},
+		{in: "  a \t b\n c  ", want: []string{"a", "b", "c"}},
+		{in: `--name "my service"`, want: []string{"--name", "my service"}},
+		{in: `--name 'my service'`, want: []string{"--name", "my service"}},
+		{in: `--greeting "it's here"`, want: []string{"--greeting", "it's here"}},
+		{in: `--quote 'say "hi"'`, want: []string{"--quote", `say "hi"`}},
+		{in: `--dir=/srv/"my app"/bin`, want: []string{"--dir=/srv/my app/bin"}},
+		{in: `my\ file`, want: []string{"my file"}},
+		{in: `"a \"quoted\" word"`, want: []string{`a "quoted" word`}},
+		{in: `'no \escape'`, want: []string{`no \escape`}},
+		{in: `"" x`, want: []string{"", "x"}},
+	}
+	for _, test := range tests {
+		got, err := splitArgs(test.in)
+		if err != nil {
+			t.Errorf("splitArgs(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSplitArgsErrors(t *testing.T) {
+	for _, in := range []string{
+		`--name "my service`,
+		`--name 'my service`,
+		`--name my\`,
+	} {
+		if got, err := splitArgs(in); err == nil {
+			t.Errorf("splitArgs(%q) = %q, want an error", in, got)
+		}
+	}
+}
+
+// TestProbeHeaders checks that an application's healthcheckHeaders and the
+// daemon's User-Agent reach the service, and that the application's own
+// User-Agent wins.
+func TestProbeHeaders(t *testing.T) {
+	received := make(chan http.Header, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+	}))
+	defer server.Close()
+
+	r := newTestRegistry(t, []string{"-userAgent=probe-test/1.0"})
+	app := application{
+		ServiceName:      "api",
+		HeartbeatURL:     server.URL + "/health",
+		HeartbeatHeaders: map[string]string{"Authorization": "Bearer token", "X-Probe": "yes"},
+	}
+	app.logger = newAppLogger(app.ServiceName)
+
+	if !r.probe(app) {
+		t.Fatal("probe failed")
+	}
+	header := <-received
+	for name, want := range map[string]string{
+		"Authorization": "Bearer token",
+		"X-Probe":       "yes",
+		"User-Agent":    "probe-test/1.0",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%v = %q, want %q", name, got, want)
+		}
+	}
+
+	app.HeartbeatHeaders["User-Agent"] = "custom"
+	if !r.probe(app) {
+		t.Fatal("probe failed")
+	}
+	if got := (<-received).Get("User-Agent"); got != "custom" {
+		t.Errorf("User-Agent = %q, want the application's own %q", got, "custom")
+	}
+}
+
+// TestProbeReloadedTimeout checks that probes use the -healthTimeout of the
+// current config, as swapped in by a SIGHUP.
+func TestProbeReloadedTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer server.Close()
+
+	r := newTestRegistry(t, []string{"-healthTimeout=5s"})
+	reloaded := &daemonConfig{}
+	if err := reloaded.loadConfig([]string{"daemon", "-allowEmptyRegistry", "-healthTimeout=100ms"}); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	r.config.Store(reloaded)
+	app := application{ServiceName: "api", HeartbeatURL: server.URL + "/health"}
+	app.logger = newAppLogger(app.ServiceName)
+
+	start := time.Now()
+	if r.probe(app) {
+		t.Fatal("probe of a service slower than -healthTimeout succeeded")
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("probe took %v, want about the reloaded 100ms timeout", took)
+	}
+}
+
+// TestProbeReusesConnections checks that successive health checks of a service
+// share one kept-alive connection instead of dialling each time.
+func TestProbeReusesConnections(t *testing.T) {
+	var mutex sync.Mutex
+	dialled := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			dialled++
+			mutex.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	r := newTestRegistry(t, nil)
+	app := application{ServiceName: "api", HeartbeatURL: server.URL + "/health"}
+	app.logger = newAppLogger(app.ServiceName)
+	for i := 0; i < 5; i++ {
+		if !r.probe(app) {
+			t.Fatalf("probe %d failed", i)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if dialled != 1 {
+		t.Errorf("5 probes opened %d connections, want 1", dialled)
+	}
+}
+
+// TestSetupHealthchecksConcurrent checks that every application gets its first
+// probe within one interval, rather than waiting on the slow probes of the
+// others.
+func TestSetupHealthchecksConcurrent(t *testing.T) {
+	const (
+		services   = 5
+		probeDelay = 500 * time.Millisecond
+		interval   = 2 * time.Second
+	)
+
+	var mutex sync.Mutex
+	probed := make(map[string]time.Time)
+	var applications []application
+	for i := 0; i < services; i++ {
+		name := string(rune('a' + i))
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			if _, ok := probed[name]; !ok {
+				probed[name] = time.Now()
+			}
+			mutex.Unlock()
+			time.Sleep(probeDelay)
+		}))
+		defer server.Close()
+		applications = append(applications, application{ServiceName: serviceName(name), HeartbeatURL: server.URL + "/health"})
+	}
+	r := newTestRegistry(t, []string{"-Interval=" + interval.String(), "-healthJitter=0", "-healthRetries=1"}, applications...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	started := time.Now()
+	go func() {
+		defer close(stopped)
+		r.setupHealthchecks(ctx, 0)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// One at a time the probes would take services*probeDelay, longer than
+	// the interval.
+	deadline := time.Now().Add(interval)
+	for {
+		mutex.Lock()
+		n := len(probed)
+		mutex.Unlock()
+		if n == services {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d services probed within %v", n, services, interval)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for name, at := range probed {
+		if wait := at.Sub(started); wait > probeDelay {
+			t.Errorf("%v was first probed after %v, want within %v", name, wait, probeDelay)
+		}
+	}
+}
+
+// TestRegistryStateRestore checks that a restart restores applications
+// registered at runtime and the status of ones still in the app file, but not
+// ones since removed from the app file or invalid ones.
+func TestRegistryStateRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	previous := newTestRegistry(t, nil,
+		application{ServiceName: "api", HeartbeatURL: "http://127.0.0.1:1/health"},
+		application{ServiceName: "gone", HeartbeatURL: "http://127.0.0.1:2/health"},
+		application{ServiceName: "registered", HeartbeatURL: "http://127.0.0.1:3/health"},
+		application{ServiceName: "invalid"},
+	)
+	previous.applications[0].fromFile = true
+	previous.applications[0].Status = statusDown
+	previous.applications[1].fromFile = true
+	if err := previous.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("state file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	r := newTestRegistry(t, nil, application{ServiceName: "api", HeartbeatURL: "http://127.0.0.1:1/health"})
+	r.applications[0].fromFile = true
+	if err := r.load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var names []serviceName
+	for _, app := range r.snapshot() {
+		names = append(names, app.ServiceName)
+	}
+	if want := []serviceName{"api", "registered"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("restored %v, want %v", names, want)
+	}
+	if app, _ := r.get("api"); app.Status != statusDown || !app.fromFile {
+		t.Errorf("api restored with status %q, fromFile %v, want %q, true", app.Status, app.fromFile, statusDown)
+	}
+	if app, _ := r.get("registered"); app.fromFile {
+		t.Error("registered application restored as coming from the app file")
+	}
+}
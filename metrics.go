@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/** Prometheus metrics */
+
+// counters are the daemon-wide counters exported at /metrics.
+var counters struct {
+	healthChecks   atomic.Uint64
+	healthFailures atomic.Uint64
+	restarts       atomic.Uint64
+	logsForwarded  atomic.Uint64
+	logsInvalid    atomic.Uint64
+	logsDropped    atomic.Uint64
+	logsTruncated  atomic.Uint64
+	logsOversize   atomic.Uint64
+	// logsInflightDropped and logsInflightQueued count UDP logs that arrived
+	// with -maxForwardInflight already reached.
+	logsInflightDropped atomic.Uint64
+	logsInflightQueued  atomic.Uint64
+}
+
+// handleMetrics serves the counters and current application states in the
+// Prometheus text exposition format.
+func (api *apiServer) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	applications := api.registry.snapshot()
+	states := map[appStatus]int{statusUnknown: 0, statusUp: 0, statusDown: 0, statusDegraded: 0}
+	for _, app := range applications {
+		states[app.Status]++
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "littledaemons_health_checks_total", "counter", "Health checks run.", counters.healthChecks.Load())
+	writeMetric(w, "littledaemons_health_check_failures_total", "counter", "Health checks that found an application down.", counters.healthFailures.Load())
+	writeMetric(w, "littledaemons_restarts_total", "counter", "Application restart attempts.", counters.restarts.Load())
+	writeMetric(w, "littledaemons_logs_forwarded_total", "counter", "Log messages forwarded to the -forward URL.", counters.logsForwarded.Load())
+	writeMetric(w, "littledaemons_logs_dropped_total", "counter", "Logs dropped because the forward queue was full or the -forward URL kept failing.", counters.logsDropped.Load())
+	writeMetric(w, "littledaemons_logs_invalid_total", "counter", "Log packets rejected for a missing or malformed header.", counters.logsInvalid.Load())
+	writeMetric(w, "littledaemons_logs_truncated_total", "counter", "Log messages truncated to -maxLogMessageSize.", counters.logsTruncated.Load())
+	writeMetric(w, "littledaemons_logs_oversize_dropped_total", "counter", "Log messages dropped for being over -maxLogMessageSize.", counters.logsOversize.Load())
+	writeMetric(w, "littledaemons_logs_inflight_dropped_total", "counter", "UDP logs dropped because -maxForwardInflight were already in flight.", counters.logsInflightDropped.Load())
+	writeMetric(w, "littledaemons_logs_inflight_queued_total", "counter", "UDP logs that waited because -maxForwardInflight were already in flight.", counters.logsInflightQueued.Load())
+
+	fmt.Fprintln(w, "# HELP littledaemons_applications Registered applications by status.")
+	fmt.Fprintln(w, "# TYPE littledaemons_applications gauge")
+	for _, status := range []appStatus{statusUnknown, statusUp, statusDown, statusDegraded} {
+		fmt.Fprintf(w, "littledaemons_applications{status=%q} %d\n", status, states[status])
+	}
+
+	fmt.Fprintln(w, "# HELP littledaemons_health_check_latency_seconds Latest health-check round trip per application.")
+	fmt.Fprintln(w, "# TYPE littledaemons_health_check_latency_seconds gauge")
+	for _, app := range applications {
+		fmt.Fprintf(w, "littledaemons_health_check_latency_seconds{name=%q} %g\n", app.ServiceName, time.Duration(app.LastLatency).Seconds())
+	}
+	fmt.Fprintln(w, "# HELP littledaemons_health_check_latency_avg_seconds Rolling average health-check round trip per application.")
+	fmt.Fprintln(w, "# TYPE littledaemons_health_check_latency_avg_seconds gauge")
+	for _, app := range applications {
+		fmt.Fprintf(w, "littledaemons_health_check_latency_avg_seconds{name=%q} %g\n", app.ServiceName, time.Duration(app.AvgLatency).Seconds())
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
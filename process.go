@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/** Process management */
+
+const (
+	// dependencyTimeout is how long an application waits at start-up for the
+	// applications it depends on to become healthy.
+	dependencyTimeout      = 30 * time.Second
+	dependencyPollInterval = 1 * time.Second
+)
+
+// newAppLogger returns a logger that prefixes every line with the service name.
+func newAppLogger(name serviceName) *log.Logger {
+	return log.New(log.Writer(), fmt.Sprintf("[%v] ", name), log.Flags()|log.Lmsgprefix)
+}
+
+// lineLogger is an io.Writer that logs each complete line written to it, so a
+// child's output shows up in the daemon log one line per entry.
+type lineLogger struct {
+	logger  *log.Logger
+	mutex   sync.Mutex
+	pending []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.pending = append(l.pending, p...)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			break
+		}
+		l.logger.Println(string(l.pending[:i]))
+		l.pending = l.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs any trailing output that didn't end in a newline.
+func (l *lineLogger) flush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.pending) > 0 {
+		l.logger.Println(string(l.pending))
+		l.pending = nil
+	}
+}
+
+// runtimeBinary runs an application's path directly as an executable.
+const runtimeBinary = "binary"
+
+// interpreters maps each supported Runtime to the executable that runs the
+// application's path.
+var interpreters = map[string]string{
+	"node":    "node",
+	"python":  "python3",
+	"python3": "python3",
+	"shell":   "sh",
+}
+
+// resolveCommand turns app's Runtime and AppPath into the executable and
+// arguments to start it with.
+func resolveCommand(app application) (string, []string, error) {
+	if app.Runtime == "" || app.AppPath == "" {
+		return "", nil, fmt.Errorf("%v has no runtime and path to start", app.ServiceName)
+	}
+	if app.Runtime == runtimeBinary {
+		return app.AppPath, app.Args, nil
+	}
+	interpreter, ok := interpreters[app.Runtime]
+	if !ok {
+		return "", nil, fmt.Errorf("%v has unknown runtime %q", app.ServiceName, app.Runtime)
+	}
+	return interpreter, append([]string{app.AppPath}, app.Args...), nil
+}
+
+// startApplication launches app's process in the background with its stdout
+// and stderr written to output. The process inherits the daemon's environment,
+// plus app.Env, and runs in app.WorkingDir if one is given.
+func startApplication(app application, output *lineLogger) (*exec.Cmd, error) {
+	name, args, err := resolveCommand(app)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = app.WorkingDir
+	if len(app.Env) > 0 {
+		cmd.Env = os.Environ()
+		for key, value := range app.Env {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// startOrder sorts applications so each comes after everything it depends on.
+// It fails on a dependency that isn't listed or on a dependency cycle.
+func startOrder(applications []application) ([]application, error) {
+	byName := make(map[serviceName]application, len(applications))
+	for _, app := range applications {
+		byName[app.ServiceName] = app
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[serviceName]int, len(applications))
+	ordered := make([]application, 0, len(applications))
+	var visit func(app application, path []serviceName) error
+	visit = func(app application, path []serviceName) error {
+		path = append(path, app.ServiceName)
+		switch state[app.ServiceName] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", joinNames(path))
+		case visited:
+			return nil
+		}
+		state[app.ServiceName] = visiting
+		for _, name := range app.DependsOn {
+			dependency, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("application %v depends on unknown application %v", app.ServiceName, name)
+			}
+			if err := visit(dependency, path); err != nil {
+				return err
+			}
+		}
+		state[app.ServiceName] = visited
+		ordered = append(ordered, app)
+		return nil
+	}
+
+	for _, app := range applications {
+		if err := visit(app, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// joinNames formats a dependency path as "A -> B -> A".
+func joinNames(names []serviceName) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(" -> ")
+		}
+		b.WriteString(string(name))
+	}
+	return b.String()
+}
+
+// waitHealthy probes app until it passes or timeout runs out, reporting
+// whether it became healthy.
+func (r *registry) waitHealthy(app application, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if r.probe(app) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(dependencyPollInterval)
+	}
+}
+
+// startApplications starts every registered application that doesn't answer a
+// pre-flight health check, so services already running are left alone.
+// Applications are started after their dependencies, once those are healthy.
+//
+// With a timeout, start-up ends once it has passed, applications not yet
+// started are skipped, and it then waits for every application to be healthy
+// until the timeout, returning an error listing any that aren't.
+func (r *registry) startApplications(timeout time.Duration) error {
+	applications, err := startOrder(r.snapshot())
+	if err != nil {
+		logError("Not starting applications: %v.", err)
+		return nil
+	}
+
+	byName := make(map[serviceName]application, len(applications))
+	for _, app := range applications {
+		byName[app.ServiceName] = app
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for _, app := range applications {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			logWarn("Start-up took longer than %v, not starting the remaining applications.", timeout)
+			break
+		}
+		for _, name := range app.DependsOn {
+			wait := dependencyTimeout
+			if !deadline.IsZero() && time.Until(deadline) < wait {
+				wait = time.Until(deadline)
+			}
+			if !r.waitHealthy(byName[name], wait) {
+				logWarn("%v isn't healthy after %v, starting %v anyway.", name, wait.Round(time.Second), app.ServiceName)
+			}
+		}
+		if r.probe(app) {
+			app.logger.Println("Already running.")
+			continue
+		}
+		if err := r.launch(app); err != nil {
+			logAt(app.logger, levelError, "Failed to start: %v", err)
+		}
+	}
+	if deadline.IsZero() {
+		return nil
+	}
+
+	var unhealthy []serviceName
+	for _, app := range applications {
+		if !r.waitHealthy(app, time.Until(deadline)) {
+			unhealthy = append(unhealthy, app.ServiceName)
+		}
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("%d of %d applications weren't healthy within %v: %v", len(unhealthy), len(applications), timeout, unhealthy)
+	}
+	return nil
+}
+
+// launch starts app and tracks its process in the registry until it exits.
+func (r *registry) launch(app application) error {
+	output := &lineLogger{logger: app.logger}
+	cmd, err := startApplication(app, output)
+	if err != nil {
+		return err
+	}
+	app.logger.Printf("Started with pid %d.", cmd.Process.Pid)
+	exited := make(chan struct{})
+	r.update(app.ServiceName, func(app *application) {
+		app.cmd = cmd
+		app.PID = cmd.Process.Pid
+		app.Started = time.Now()
+		app.exited = exited
+	})
+
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+		output.flush()
+		app.logger.Printf("Pid %d exited: %v", cmd.Process.Pid, err)
+		r.update(app.ServiceName, func(app *application) {
+			if app.cmd == cmd {
+				app.cmd = nil
+				app.PID = 0
+				app.exited = nil
+			}
+		})
+	}()
+	return nil
+}
+
+// restartApplication starts app again after it has failed its health checks,
+// killing the process the daemon previously started for it, if any.
+func (r *registry) restartApplication(app application, attempt int) {
+	app.logger.Printf("Restarting (attempt %d).", attempt)
+	counters.restarts.Add(1)
+	var previous *exec.Cmd
+	r.update(app.ServiceName, func(app *application) {
+		app.Restarts++
+		previous = app.cmd
+	})
+	if previous != nil {
+		if err := previous.Process.Kill(); err != nil {
+			logAt(app.logger, levelError, "Failed to stop pid %d: %v", previous.Process.Pid, err)
+		}
+	}
+	if err := r.launch(app); err != nil {
+		logAt(app.logger, levelError, "Failed to restart: %v", err)
+	}
+}
+
+// logRestart logs what restartApplication would do for app, without doing it.
+func (r *registry) logRestart(app application, attempt int) {
+	name, args, err := resolveCommand(app)
+	if err != nil {
+		app.logger.Printf("Dry run: would restart (attempt %d), but can't: %v", attempt, err)
+		return
+	}
+	if current, ok := r.get(app.ServiceName); ok && current.PID != 0 {
+		app.logger.Printf("Dry run: would kill pid %d.", current.PID)
+	}
+	app.logger.Printf("Dry run: would restart (attempt %d) with %v %v.", attempt, name, strings.Join(args, " "))
+}
+
+// stopApplications sends SIGTERM to every process the daemon started and waits
+// up to grace for them to exit, killing any that are still running after that.
+func (r *registry) stopApplications(grace time.Duration) {
+	var running []application
+	for _, app := range r.snapshot() {
+		if app.cmd == nil {
+			continue
+		}
+		log.Printf("Stopping %v (pid %d).", app.ServiceName, app.PID)
+		if err := app.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			logError("Failed to signal %v (pid %d): %v", app.ServiceName, app.PID, err)
+		}
+		running = append(running, app)
+	}
+
+	timeout := time.After(grace)
+wait:
+	for _, app := range running {
+		select {
+		case <-app.exited:
+		case <-timeout:
+			break wait
+		}
+	}
+
+	for _, app := range running {
+		select {
+		case <-app.exited:
+		default:
+			logWarn("%v (pid %d) didn't exit within %v, killing it.", app.ServiceName, app.PID, grace)
+			app.cmd.Process.Kill()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+/** Graceful restart */
+
+// logSocketEnv tells a re-executed daemon which file descriptor holds the UDP
+// log socket it inherited.
+const logSocketEnv = "LITTLEDAEMONS_LOG_FD"
+
+// logSocket is the UDP log socket, kept so SIGUSR2 can hand it over to the
+// next daemon.
+var logSocket struct {
+	mutex sync.Mutex
+	conn  net.PacketConn
+}
+
+// listenLogSocket returns the UDP log socket inherited from the previous
+// daemon if there is one for addr, and otherwise opens a new one on network.
+func listenLogSocket(network, addr string) (net.PacketConn, error) {
+	if fd, ok := os.LookupEnv(logSocketEnv); ok {
+		os.Unsetenv(logSocketEnv)
+		conn, err := inheritedPacketConn(fd, addr)
+		if err == nil {
+			log.Printf("Took over log socket %v from the previous daemon.", conn.LocalAddr())
+			return conn, nil
+		}
+		logError("Failed to take over the log socket, opening a new one: %v.", err)
+	}
+	return net.ListenPacket(network, addr)
+}
+
+// inheritedPacketConn turns file descriptor fd into a packet conn, as long as
+// it is bound to addr's port.
+func inheritedPacketConn(fd, addr string) (net.PacketConn, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%v=%q is not a file descriptor", logSocketEnv, fd)
+	}
+	file := os.NewFile(uintptr(n), "log socket")
+	if file == nil {
+		return nil, fmt.Errorf("file descriptor %d is not open", n)
+	}
+	// FilePacketConn works on a duplicate, so the original isn't left behind
+	// for started applications to inherit.
+	defer file.Close()
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	_, want, _ := net.SplitHostPort(addr)
+	if _, port, _ := net.SplitHostPort(conn.LocalAddr().String()); port != want {
+		conn.Close()
+		return nil, fmt.Errorf("inherited socket is on port %v, not %v", port, want)
+	}
+	return conn, nil
+}
+
+// setLogSocket records the UDP log socket in use, or nil once it is closed.
+func setLogSocket(conn net.PacketConn) {
+	logSocket.mutex.Lock()
+	logSocket.conn = conn
+	logSocket.mutex.Unlock()
+}
+
+// logSocketFile returns a duplicate of the UDP log socket that stays open after
+// the log service stops, or nil if there is no log service.
+func logSocketFile() (*os.File, error) {
+	logSocket.mutex.Lock()
+	defer logSocket.mutex.Unlock()
+	if logSocket.conn == nil {
+		return nil, nil
+	}
+	udp, ok := logSocket.conn.(*net.UDPConn)
+	if !ok {
+		return nil, fmt.Errorf("log socket is a %T", logSocket.conn)
+	}
+	return udp.File()
+}
+
+// reexec starts a new daemon from the same binary with the same arguments,
+// handing it socket, if not nil, as its UDP log socket.
+func reexec(socket *os.File) error {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if socket != nil {
+		// ExtraFiles start at file descriptor 3 in the new process.
+		cmd.ExtraFiles = []*os.File{socket}
+		cmd.Env = append(cmd.Env, logSocketEnv+"=3")
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started new daemon with pid %d.", cmd.Process.Pid)
+	return nil
+}
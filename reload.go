@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/** Application list reloading */
+
+// watchDebounce is how long -watch waits for the app file to settle before
+// reloading it.
+const watchDebounce = 500 * time.Millisecond
+
+// definition returns a copy of a with its runtime state cleared, leaving only
+// what the app file describes.
+func (a application) definition() application {
+	a.Status = ""
+	a.LastChecked = time.Time{}
+	a.Restarts = 0
+	a.ConsecutiveFailures = 0
+	a.ConsecutiveSuccesses = 0
+	a.LastLatency = 0
+	a.AvgLatency = 0
+	a.LastTransition = time.Time{}
+	a.Uptime = 0
+	a.Downtime = 0
+	a.PID = 0
+	a.Started = time.Time{}
+	a.Draining = false
+	a.logger = nil
+	a.cmd = nil
+	a.exited = nil
+	a.fromFile = false
+	return a
+}
+
+// redefine replaces a's definition with def's, keeping a's runtime state.
+func (a *application) redefine(def application) {
+	state := *a
+	*a = def.definition()
+	a.Status = state.Status
+	a.LastChecked = state.LastChecked
+	a.Restarts = state.Restarts
+	a.ConsecutiveFailures = state.ConsecutiveFailures
+	a.ConsecutiveSuccesses = state.ConsecutiveSuccesses
+	a.LastLatency = state.LastLatency
+	a.AvgLatency = state.AvgLatency
+	a.LastTransition = state.LastTransition
+	a.Uptime = state.Uptime
+	a.Downtime = state.Downtime
+	a.PID = state.PID
+	a.Started = state.Started
+	a.Draining = state.Draining
+	a.logger = state.logger
+	a.cmd = state.cmd
+	a.exited = state.exited
+	a.fromFile = state.fromFile
+}
+
+// reload re-reads the application file and reconciles the registry with it. If
+// the file can't be read the current applications are kept.
+func (r *registry) reload(config *daemonConfig) {
+	if config.appFile == "" {
+		return
+	}
+	applications, err := readApplicationList(config.appFile, config.skipInvalid)
+	if err != nil {
+		logError("Keeping current applications, reload failed: %v.", err)
+		return
+	}
+	r.reconcile(applications)
+}
+
+// reconcile makes the registry match applications, the app file's list: new
+// ones are added and monitored, ones that came from the app file but are no
+// longer in it are deregistered, and changed ones have their health checks
+// restarted with the new definition. Unchanged applications are left alone, so
+// their checks carry on uninterrupted. Listing an application registered some
+// other way hands it over to the app file.
+func (r *registry) reconcile(applications []application) {
+	current := make(map[serviceName]application)
+	for _, app := range r.snapshot() {
+		current[app.ServiceName] = app
+	}
+
+	for _, app := range applications {
+		existing, ok := current[app.ServiceName]
+		delete(current, app.ServiceName)
+		app.fromFile = true
+		switch {
+		case !ok:
+			app.Status = statusUnknown
+			if err := r.add(app); err != nil {
+				logError("Failed to add %v: %v.", app.ServiceName, err)
+				continue
+			}
+			log.Printf("Added %v.", app.ServiceName)
+		case !reflect.DeepEqual(existing.definition(), app.definition()):
+			r.update(app.ServiceName, func(registered *application) {
+				registered.redefine(app)
+				registered.fromFile = true
+			})
+			log.Printf("Updated %v.", app.ServiceName)
+		default:
+			if !existing.fromFile {
+				r.update(app.ServiceName, func(registered *application) {
+					registered.fromFile = true
+				})
+			}
+			continue
+		}
+		updated, _ := r.get(app.ServiceName)
+		go r.monitor(r.monitorContext(app.ServiceName), updated)
+	}
+
+	for name, app := range current {
+		if !app.fromFile {
+			continue
+		}
+		if err := r.removeByName(name); err == nil {
+			log.Printf("Removed %v.", name)
+		}
+	}
+}
+
+// watchApplications reloads the application list whenever -appFile changes on
+// disk, until ctx is done. Events are debounced so an editor's burst of writes
+// causes a single reload.
+func (r *registry) watchApplications(ctx context.Context, config *daemonConfig) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Editors often replace a file rather than write to it, which a watch on
+	// the file itself would lose, so the directory holding it is watched.
+	appFile := filepath.Clean(config.appFile)
+	dir := appFile
+	if info, err := os.Stat(appFile); err != nil {
+		return err
+	} else if !info.IsDir() {
+		dir = filepath.Dir(appFile)
+	}
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+	log.Printf("Watching %v for changes.", appFile)
+
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if dir != appFile && filepath.Clean(event.Name) != appFile {
+				continue
+			}
+			debounce.Reset(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logError("Failed to watch %v: %v", appFile, err)
+		case <-debounce.C:
+			log.Printf("%v changed, reloading applications.", appFile)
+			r.reload(r.config.Load())
+		}
+	}
+}
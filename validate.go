@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/** validate subcommand */
+
+// runValidate implements "daemon validate -appFile apps.json": it checks the
+// app file the same way the daemon would load it, prints every problem found
+// and returns the exit code, without starting any servers or health checks.
+func runValidate(args []string) int {
+	config := &daemonConfig{}
+	if err := config.loadConfig(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Config error: %s\n", err)
+		return 1
+	}
+	if config.appFile == "" {
+		fmt.Fprintln(os.Stderr, "validate needs an -appFile")
+		return 2
+	}
+
+	list, err := parseApplicationList(config.appFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %s\n", config.appFile, err)
+		return 1
+	}
+	problems := append(list.unreadable, list.invalid...)
+	if _, err := startOrder(list.applications); err != nil {
+		problems = append(problems, err)
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%v: %d problems found.\n", config.appFile, len(problems))
+		return 1
+	}
+	fmt.Printf("%v: %d applications OK.\n", config.appFile, len(list.applications))
+	return 0
+}